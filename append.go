@@ -0,0 +1,113 @@
+package interpolate
+
+// An AppendEnv is an Env that can append the value of a variable to a buffer. AppendExpand uses it
+// when it can, so environments that don't store values as strings needn't allocate one for each
+// lookup.
+type AppendEnv interface {
+	Env
+
+	// AppendValue appends the value of key to dst, returning the extended buffer and whether key is set
+	AppendValue(dst []byte, key string) ([]byte, bool)
+}
+
+// appendExpander is implemented by expansions that can append their result to a buffer without
+// allocating, which AppendExpand uses rather than Expand
+type appendExpander interface {
+	appendExpand(dst []byte, env Env) ([]byte, error)
+}
+
+// AppendExpand is like Expand, but appends the result to dst and returns the extended buffer. Reusing
+// the buffer avoids allocating, and expressions containing only text, variables, defaults and
+// alternate values can be expanded without allocating at all. If an expansion fails, the buffer
+// is returned with everything before it appended.
+func (e Expression) AppendExpand(dst []byte, env Env) ([]byte, error) {
+	var errs []*ExpansionError
+	continueOnError := optionsOf(env).ContinueOnError
+
+	for _, item := range e {
+		var err error
+		switch exp := item.Expansion.(type) {
+		case nil:
+			dst = append(dst, item.Text...)
+		case appendExpander:
+			dst, err = exp.appendExpand(dst, env)
+		default:
+			var result string
+			result, err = exp.Expand(env)
+			dst = append(dst, result...)
+		}
+		if err != nil {
+			if !continueOnError {
+				return dst, withSpan(err, item.Span)
+			}
+			errs = addExpansionError(errs, err, item.Span)
+		}
+	}
+	return dst, expansionErrors(errs)
+}
+
+// AppendExpand is like Expand, but appends the result to dst and returns the extended buffer, as
+// Expression.AppendExpand does
+func (t *Template) AppendExpand(dst []byte, env Env) ([]byte, error) {
+	if env == nil {
+		env = NewSliceEnv(nil)
+	}
+	return t.expr.AppendExpand(dst, withOptions(env, t.opts))
+}
+
+// appendValue appends the value of key in env to dst, returning whether it's set
+func appendValue(dst []byte, env Env, key string) ([]byte, bool) {
+	if ae, ok := unwrapEnv(env).(AppendEnv); ok {
+		return ae.AppendValue(dst, key)
+	}
+	val, ok := env.Get(key)
+	return append(dst, val...), ok
+}
+
+func (e VariableExpansion) appendExpand(dst []byte, env Env) ([]byte, error) {
+	dst, ok := appendValue(dst, env, e.Identifier)
+	if !ok && optionsOf(env).NoUnset {
+		return dst, &UnsetVariableError{Name: e.Identifier}
+	}
+	return dst, nil
+}
+
+func (e EmptyValueExpansion) appendExpand(dst []byte, env Env) ([]byte, error) {
+	n := len(dst)
+	if dst, ok := appendValue(dst, env, e.Identifier); ok && len(dst) > n {
+		return dst, nil
+	}
+	return e.Content.AppendExpand(dst[:n], env)
+}
+
+func (e UnsetValueExpansion) appendExpand(dst []byte, env Env) ([]byte, error) {
+	n := len(dst)
+	if dst, ok := appendValue(dst, env, e.Identifier); ok {
+		return dst, nil
+	}
+	return e.Content.AppendExpand(dst[:n], env)
+}
+
+func (e AlternateValueExpansion) appendExpand(dst []byte, env Env) ([]byte, error) {
+	// the value is only appended to find out if it's empty, so it's removed again afterwards
+	n := len(dst)
+	dst, ok := appendValue(dst, env, e.Identifier)
+	if !ok || (e.CheckEmpty && len(dst) == n) {
+		return dst[:n], nil
+	}
+	return e.Content.AppendExpand(dst[:n], env)
+}
+
+func (e RequiredExpansion) appendExpand(dst []byte, env Env) ([]byte, error) {
+	n := len(dst)
+	if dst, ok := appendValue(dst, env, e.Identifier); ok && !(e.CheckEmpty && len(dst) == n) {
+		return dst, nil
+	}
+	// the error message is worth allocating for
+	_, err := e.Expand(env)
+	return dst[:n], err
+}
+
+func (e EscapedExpansion) appendExpand(dst []byte, env Env) ([]byte, error) {
+	return append(dst, '$'), nil
+}
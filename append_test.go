@@ -0,0 +1,126 @@
+package interpolate_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/buildkite/interpolate"
+)
+
+// bytesEnv is an AppendEnv that stores its values as bytes
+type bytesEnv map[string][]byte
+
+func (e bytesEnv) Get(key string) (string, bool) {
+	val, ok := e[key]
+	return string(val), ok
+}
+
+func (e bytesEnv) AppendValue(dst []byte, key string) ([]byte, bool) {
+	val, ok := e[key]
+	return append(dst, val...), ok
+}
+
+func TestAppendExpand(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"HELLO_WORLD": "🦀",
+		"EMPTY":       "",
+		"NAME":        "Dolly",
+	})
+
+	for _, str := range []string{
+		`Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}`,
+		`${EMPTY:-empty} ${EMPTY-unset} ${UNSET-unset} ${UNSET:-${NAME:-nope}}`,
+		`${NAME:+set} ${EMPTY:+set} ${EMPTY+set} ${UNSET+set} ${NAME?} ${EMPTY?}`,
+		`$$NAME \$NAME ${NAME//l/L} ${#NAME} $((1 + 2)) ${NAME@Q}`,
+	} {
+		expected, err := interpolate.Interpolate(environ, str)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expr, err := interpolate.NewParser(str).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		result, err := expr.AppendExpand([]byte("prefix: "), environ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(result) != "prefix: "+expected {
+			t.Fatalf("Test %q failed: Expected %q, got %q", str, "prefix: "+expected, result)
+		}
+	}
+}
+
+func TestAppendExpandErrors(t *testing.T) {
+	t.Parallel()
+
+	tmpl := interpolate.MustCompile(`Hello ${NAME}, ${GREETING:?no greeting}`)
+
+	result, err := tmpl.AppendExpand(nil, bytesEnv{"NAME": []byte("Dolly"), "GREETING": []byte("")})
+	if err == nil || err.Error() != "$GREETING: no greeting" {
+		t.Fatalf("Expected error %q, got %v", "$GREETING: no greeting", err)
+	}
+	if expected := "Hello Dolly, "; string(result) != expected {
+		t.Fatalf("Expected %q, got %q", expected, result)
+	}
+	tmpl, err = interpolate.CompileWithOptions(`Hello ${NAME}, $GREETING`, interpolate.Options{NoUnset: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = tmpl.AppendExpand(nil, bytesEnv{"NAME": []byte("Dolly")})
+
+	var unsetErr *interpolate.UnsetVariableError
+	if !errors.As(err, &unsetErr) || unsetErr.Name != "GREETING" || unsetErr.Span != (interpolate.Span{Start: 15, End: 24}) {
+		t.Fatalf("Expected an *UnsetVariableError for $GREETING, got %v", err)
+	}
+}
+
+func TestAppendExpandDoesNotAllocate(t *testing.T) {
+	tmpl := interpolate.MustCompile("Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖} ${EMPTY:-$HELLO_WORLD} ${HELLO_WORLD:+set} $$")
+
+	for name, env := range map[string]interpolate.Env{
+		"map":   interpolate.NewMapEnv(map[string]string{"HELLO_WORLD": "🦀", "EMPTY": ""}),
+		"bytes": bytesEnv{"HELLO_WORLD": []byte("🦀"), "EMPTY": []byte("")},
+	} {
+		var dst []byte
+		allocs := testing.AllocsPerRun(100, func() {
+			dst, _ = tmpl.AppendExpand(dst[:0], env)
+		})
+		if allocs != 0 {
+			t.Fatalf("Expected AppendExpand with a %s env not to allocate, got %v allocations", name, allocs)
+		}
+		if expected := "Buildkite... 🦀 🏖 🦀 set $"; string(dst) != expected {
+			t.Fatalf("Expected %q, got %q", expected, dst)
+		}
+	}
+}
+
+func BenchmarkAppendExpand(b *testing.B) {
+	env := interpolate.NewSliceEnv([]string{
+		"HELLO_WORLD=🦀",
+	})
+	tmpl := interpolate.MustCompile("Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}")
+
+	var dst []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		dst, _ = tmpl.AppendExpand(dst[:0], env)
+	}
+}
+
+func BenchmarkAppendExpandAppendEnv(b *testing.B) {
+	env := bytesEnv{"HELLO_WORLD": []byte("🦀")}
+	tmpl := interpolate.MustCompile("Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-${HELLO_WORLD}}")
+
+	var dst []byte
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		dst, _ = tmpl.AppendExpand(dst[:0], env)
+	}
+}
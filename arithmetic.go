@@ -0,0 +1,463 @@
+package interpolate
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// This is a small recursive descent evaluator for bash style arithmetic, as used by $(( expression )).
+// Unlike the main parser it doesn't build a tree, it calculates the result as it goes. Expansions
+// within the expression (like $VAR) are done before it's evaluated, just like in bash, so this only
+// ever sees numbers, operators and bare variable names.
+//
+// The operators and their precedence, from lowest to highest, are:
+//
+//	,                comma
+//	? :              ternary
+//	||               logical or
+//	&&               logical and
+//	|                bitwise or
+//	^                bitwise exclusive or
+//	&                bitwise and
+//	== !=            equality
+//	< <= > >=        comparison
+//	<< >>            bitwise shifts
+//	+ -              addition and subtraction
+//	* / %            multiplication, division and remainder
+//	**               exponentiation
+//	+ - ! ~          unary plus, minus, logical and bitwise negation
+//
+// Numbers can be decimal, octal (with a leading 0), hexadecimal (with a leading 0x) or in any base
+// from 2 to 64 written as base#number. Variables that are unset or empty are treated as 0, and
+// variables containing expressions are evaluated in turn.
+
+// maxArithmeticDepth limits how deeply variables can refer to other variables, so cycles fail quickly
+const maxArithmeticDepth = 1024
+
+// arithmeticOperators are the operators we recognise, longest first so they are matched greedily
+var arithmeticOperators = []string{
+	"**", "<<", ">>", "<=", ">=", "==", "!=", "&&", "||",
+	"+", "-", "*", "/", "%", "<", ">", "&", "^", "|", "!", "~", "?", ":", "(", ")", ",",
+}
+
+type arithmeticEvaluator struct {
+	input string // the expression we are evaluating
+	pos   int    // the current position
+	env   Env
+	depth int
+}
+
+// evaluateArithmetic evaluates an arithmetic expression, resolving variable names through env
+func evaluateArithmetic(env Env, input string) (int64, error) {
+	return evaluateArithmeticDepth(env, input, 0)
+}
+
+func evaluateArithmeticDepth(env Env, input string, depth int) (int64, error) {
+	if depth > maxArithmeticDepth {
+		return 0, errors.New("expression recursion level exceeded")
+	}
+
+	a := &arithmeticEvaluator{input: input, env: env, depth: depth}
+
+	// an empty expression is zero
+	if a.peekToken() == "" {
+		return 0, nil
+	}
+
+	val, err := a.comma(true)
+	if err != nil {
+		return 0, err
+	}
+	if tok := a.peekToken(); tok != "" {
+		return 0, a.syntaxError("unexpected token")
+	}
+	return val, nil
+}
+
+func (a *arithmeticEvaluator) comma(eval bool) (int64, error) {
+	val, err := a.ternary(eval)
+	if err != nil {
+		return 0, err
+	}
+	for a.peekToken() == "," {
+		a.nextToken()
+		if val, err = a.ternary(eval); err != nil {
+			return 0, err
+		}
+	}
+	return val, nil
+}
+
+func (a *arithmeticEvaluator) ternary(eval bool) (int64, error) {
+	cond, err := a.binary(0, eval)
+	if err != nil {
+		return 0, err
+	}
+	if a.peekToken() != "?" {
+		return cond, nil
+	}
+	a.nextToken()
+
+	// only the chosen branch is evaluated, so the other one can't fail with things like division by 0
+	ifTrue, err := a.comma(eval && cond != 0)
+	if err != nil {
+		return 0, err
+	}
+	if a.peekToken() != ":" {
+		return 0, a.syntaxError("expected `:' for conditional expression")
+	}
+	a.nextToken()
+	ifFalse, err := a.ternary(eval && cond == 0)
+	if err != nil {
+		return 0, err
+	}
+
+	if cond != 0 {
+		return ifTrue, nil
+	}
+	return ifFalse, nil
+}
+
+// binaryPrecedence lists the left associative binary operators, from lowest to highest precedence
+var binaryPrecedence = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<", "<=", ">", ">="},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+// binary parses a chain of left associative binary operators at the given precedence level
+func (a *arithmeticEvaluator) binary(level int, eval bool) (int64, error) {
+	if level == len(binaryPrecedence) {
+		return a.exponent(eval)
+	}
+
+	left, err := a.binary(level+1, eval)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op := a.peekToken()
+		if !slices.Contains(binaryPrecedence[level], op) {
+			return left, nil
+		}
+		a.nextToken()
+
+		// logical operators short circuit, so the right hand side isn't evaluated if it doesn't matter
+		rightEval := eval
+		if op == "&&" {
+			rightEval = eval && left != 0
+		} else if op == "||" {
+			rightEval = eval && left == 0
+		}
+
+		right, err := a.binary(level+1, rightEval)
+		if err != nil {
+			return 0, err
+		}
+		if !rightEval {
+			right = 0
+		}
+
+		if left, err = applyBinary(op, left, right, rightEval); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func applyBinary(op string, left, right int64, eval bool) (int64, error) {
+	switch op {
+	case "||":
+		return boolToInt(left != 0 || right != 0), nil
+	case "&&":
+		return boolToInt(left != 0 && right != 0), nil
+	case "|":
+		return left | right, nil
+	case "^":
+		return left ^ right, nil
+	case "&":
+		return left & right, nil
+	case "==":
+		return boolToInt(left == right), nil
+	case "!=":
+		return boolToInt(left != right), nil
+	case "<":
+		return boolToInt(left < right), nil
+	case "<=":
+		return boolToInt(left <= right), nil
+	case ">":
+		return boolToInt(left > right), nil
+	case ">=":
+		return boolToInt(left >= right), nil
+	case "<<":
+		return left << (uint64(right) & 63), nil
+	case ">>":
+		return left >> (uint64(right) & 63), nil
+	case "+":
+		return left + right, nil
+	case "-":
+		return left - right, nil
+	case "*":
+		return left * right, nil
+	case "/", "%":
+		if right == 0 {
+			if !eval {
+				return 0, nil
+			}
+			return 0, errors.New("division by 0")
+		}
+		if op == "/" {
+			return left / right, nil
+		}
+		return left % right, nil
+	}
+	return 0, fmt.Errorf("unknown operator %q", op)
+}
+
+// exponent parses the right associative ** operator
+func (a *arithmeticEvaluator) exponent(eval bool) (int64, error) {
+	base, err := a.unary(eval)
+	if err != nil {
+		return 0, err
+	}
+	if a.peekToken() != "**" {
+		return base, nil
+	}
+	a.nextToken()
+
+	exp, err := a.exponent(eval)
+	if err != nil {
+		return 0, err
+	}
+	if !eval {
+		return 0, nil
+	}
+	if exp < 0 {
+		return 0, errors.New("exponent less than 0")
+	}
+
+	// exponentiation by squaring, so huge exponents don't take forever
+	result := int64(1)
+	for ; exp > 0; exp >>= 1 {
+		if exp&1 == 1 {
+			result *= base
+		}
+		base *= base
+	}
+	return result, nil
+}
+
+func (a *arithmeticEvaluator) unary(eval bool) (int64, error) {
+	switch op := a.peekToken(); op {
+	case "+", "-", "!", "~":
+		a.nextToken()
+		val, err := a.unary(eval)
+		if err != nil {
+			return 0, err
+		}
+		switch op {
+		case "-":
+			return -val, nil
+		case "!":
+			return boolToInt(val == 0), nil
+		case "~":
+			return ^val, nil
+		}
+		return val, nil
+	}
+	return a.primary(eval)
+}
+
+func (a *arithmeticEvaluator) primary(eval bool) (int64, error) {
+	tok := a.peekToken()
+	switch {
+	case tok == "":
+		return 0, a.syntaxError("operand expected")
+
+	case tok == "(":
+		a.nextToken()
+		val, err := a.comma(eval)
+		if err != nil {
+			return 0, err
+		}
+		if a.peekToken() != ")" {
+			return 0, a.syntaxError("expected `)'")
+		}
+		a.nextToken()
+		return val, nil
+
+	case isDigit(tok[0]):
+		a.nextToken()
+		return parseArithmeticNumber(tok)
+
+	case isArithmeticIdentifierStart(rune(tok[0])):
+		a.nextToken()
+		if !eval {
+			return 0, nil
+		}
+		val, _, err := lookupVariable(a.env, tok)
+		if err != nil {
+			return 0, err
+		}
+		if strings.TrimSpace(val) == "" {
+			return 0, nil
+		}
+		result, err := evaluateArithmeticDepth(a.env, val, a.depth+1)
+		if err != nil {
+			// only name the outermost variable, rather than every one we went through
+			if a.depth == 0 {
+				err = fmt.Errorf("%s: %w", tok, err)
+			}
+			return 0, err
+		}
+		return result, nil
+	}
+
+	return 0, a.syntaxError("operand expected")
+}
+
+// parseArithmeticNumber parses a decimal, octal, hexadecimal or base#number constant
+func parseArithmeticNumber(tok string) (int64, error) {
+	base, digits := int64(10), tok
+	if i := strings.IndexByte(tok, '#'); i >= 0 {
+		b, err := parseArithmeticNumber(tok[:i])
+		if err != nil || b < 2 || b > 64 {
+			return 0, fmt.Errorf("invalid arithmetic base (error token is %q)", tok)
+		}
+		base, digits = b, tok[i+1:]
+	} else if strings.HasPrefix(tok, "0x") || strings.HasPrefix(tok, "0X") {
+		base, digits = 16, tok[2:]
+	} else if len(tok) > 1 && tok[0] == '0' {
+		base, digits = 8, tok[1:]
+	}
+
+	if digits == "" {
+		return 0, fmt.Errorf("invalid number (error token is %q)", tok)
+	}
+
+	var val int64
+	for i := 0; i < len(digits); i++ {
+		digit := arithmeticDigitValue(digits[i], base)
+		if digit < 0 || digit >= base {
+			return 0, fmt.Errorf("value too great for base (error token is %q)", tok)
+		}
+		val = val*base + digit
+	}
+	return val, nil
+}
+
+// arithmeticDigitValue returns the value of a digit. Bases above 36 use lowercase letters, then
+// uppercase letters, then @ and _, while smaller bases don't care about case.
+func arithmeticDigitValue(c byte, base int64) int64 {
+	switch {
+	case '0' <= c && c <= '9':
+		return int64(c - '0')
+	case 'a' <= c && c <= 'z':
+		return int64(c-'a') + 10
+	case 'A' <= c && c <= 'Z':
+		if base <= 36 {
+			return int64(c-'A') + 10
+		}
+		return int64(c-'A') + 36
+	case c == '@':
+		return 62
+	case c == '_':
+		return 63
+	}
+	return -1
+}
+
+// peekToken returns the next token without consuming it, or an empty string at the end of the input
+func (a *arithmeticEvaluator) peekToken() string {
+	start := a.pos
+	tok := a.nextToken()
+	a.pos = start
+	return tok
+}
+
+func (a *arithmeticEvaluator) nextToken() string {
+	for a.pos < len(a.input) && strings.IndexByte(" \t\r\n", a.input[a.pos]) >= 0 {
+		a.pos++
+	}
+	if a.pos >= len(a.input) {
+		return ""
+	}
+
+	start := a.pos
+	c := a.input[a.pos]
+
+	// numbers and identifiers are runs of word characters, we validate numbers when they're parsed
+	if isDigit(c) || isArithmeticIdentifierStart(rune(c)) {
+		for a.pos < len(a.input) && isArithmeticWordChar(a.input[a.pos], isDigit(c)) {
+			a.pos++
+		}
+		return a.input[start:a.pos]
+	}
+
+	for _, op := range arithmeticOperators {
+		if strings.HasPrefix(a.input[a.pos:], op) {
+			a.pos += len(op)
+			return op
+		}
+	}
+
+	// anything else is a token we don't understand, which will be a syntax error
+	a.pos++
+	return a.input[start:a.pos]
+}
+
+func (a *arithmeticEvaluator) syntaxError(msg string) error {
+	start := a.pos
+	tok := a.nextToken()
+	a.pos = start
+	if tok == "" {
+		return fmt.Errorf("syntax error: %s", msg)
+	}
+	return fmt.Errorf("syntax error: %s (error token is %q)", msg, strings.TrimSpace(a.input[start:]))
+}
+
+// arithmeticIdentifiers returns the variable names used in an arithmetic expression, along with the
+// offset of each one in input
+func arithmeticIdentifiers(input string) (identifiers []string, offsets []int) {
+	identifiers = []string{}
+	a := &arithmeticEvaluator{input: input}
+	for tok := a.nextToken(); tok != ""; tok = a.nextToken() {
+		if isArithmeticIdentifierStart(rune(tok[0])) {
+			identifiers = append(identifiers, tok)
+			offsets = append(offsets, a.pos-len(tok))
+		}
+	}
+	return identifiers, offsets
+}
+
+func isDigit(c byte) bool {
+	return '0' <= c && c <= '9'
+}
+
+func isArithmeticIdentifierStart(r rune) bool {
+	return r == '_' || (r < unicode.MaxASCII && unicode.IsLetter(r))
+}
+
+func isArithmeticWordChar(c byte, number bool) bool {
+	if number && (c == '#' || c == '@') {
+		return true
+	}
+	return c == '_' || isDigit(c) || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+func boolToInt(b bool) int64 {
+	if b {
+		return 1
+	}
+	return 0
+}
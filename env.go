@@ -9,6 +9,25 @@ type Env interface {
 	Get(key string) (string, bool)
 }
 
+// MutableEnv is an Env that can also be assigned to, as required by expansions like ${VAR:=word}
+type MutableEnv interface {
+	Env
+	Set(key, value string)
+}
+
+// EnumerableEnv is an Env that can also list the keys it contains, as required by expansions like ${!PREFIX*}
+type EnumerableEnv interface {
+	Env
+	Keys() []string
+}
+
+// ArgsEnv is an Env that also has positional arguments, as required by expansions like $1, $# and $@.
+// Without one, those expansions are left as they are.
+type ArgsEnv interface {
+	Env
+	Args() []string
+}
+
 // Creates an Env from a slice of environment variables
 func NewSliceEnv(env []string) Env {
 	envMap := mapEnv{}
@@ -40,6 +59,53 @@ func (m mapEnv) Get(key string) (string, bool) {
 	return val, ok
 }
 
+func (m mapEnv) Set(key, value string) {
+	if m == nil {
+		return
+	}
+	m[normalizeKeyName(key)] = value
+}
+
+func (m mapEnv) Keys() []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// optionsEnv carries the Options an expression is being expanded with. Expansions are only passed an
+// Env, so this is how options reach expansions nested inside other expansions.
+type optionsEnv struct {
+	Env
+	opts Options
+}
+
+// withOptions returns env with opts attached, replacing any options already attached to it. Options
+// that only change parsing aren't needed, so if there aren't any others env is returned unwrapped.
+func withOptions(env Env, opts Options) Env {
+	if opts.CommandRunner == nil && !opts.NoUnset && !opts.ContinueOnError {
+		return unwrapEnv(env)
+	}
+	return optionsEnv{Env: unwrapEnv(env), opts: opts}
+}
+
+// optionsOf returns the options attached to env, if there are any
+func optionsOf(env Env) Options {
+	if o, ok := env.(optionsEnv); ok {
+		return o.opts
+	}
+	return Options{}
+}
+
+// unwrapEnv returns the Env that was passed in by the caller, so its optional interfaces can be used
+func unwrapEnv(env Env) Env {
+	if o, ok := env.(optionsEnv); ok {
+		return o.Env
+	}
+	return env
+}
+
 // Windows isn't case sensitive for env
 func normalizeKeyName(key string) string {
 	if runtime.GOOS == "windows" {
@@ -0,0 +1,147 @@
+package interpolate
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// ParseErrorKind identifies the kind of problem a ParseError describes, for callers that want to
+// handle some kinds differently without matching on error messages
+type ParseErrorKind string
+
+const (
+	// ParseErrorUnterminated is something like a brace expansion or a quoted string that doesn't end
+	ParseErrorUnterminated ParseErrorKind = "unterminated"
+
+	// ParseErrorInvalidOperator is an unknown operator in a brace expansion, like ${VAR~word}
+	ParseErrorInvalidOperator ParseErrorKind = "invalid-operator"
+
+	// ParseErrorInvalidIdentifier is a brace expansion without a valid variable name, like ${-VAR}
+	ParseErrorInvalidIdentifier ParseErrorKind = "invalid-identifier"
+
+	// ParseErrorInvalidNumber is a number that can't be parsed, like the offset in ${VAR:one}
+	ParseErrorInvalidNumber ParseErrorKind = "invalid-number"
+
+	// ParseErrorUnexpected is any other unexpected character
+	ParseErrorUnexpected ParseErrorKind = "unexpected"
+)
+
+// ParseError is returned by Parser.Parse when the input can't be parsed. It records where in the
+// input the problem is, so that it can be pointed out.
+type ParseError struct {
+	Kind    ParseErrorKind
+	Message string
+
+	Offset int // the offset in bytes from the start of the input
+	Line   int // the line number, starting at 1
+	Column int // the column in characters, starting at 1
+
+	// Snippet is the whole line of input containing the error, so that a caret can be drawn under
+	// the character at Column
+	Snippet string
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%s (line %d, column %d)", e.Message, e.Line, e.Column)
+}
+
+// newParseError returns a ParseError for the problem at offset in input
+func newParseError(input string, offset int, kind ParseErrorKind, format string, args ...any) *ParseError {
+	lineStart := strings.LastIndexByte(input[:offset], '\n') + 1
+	lineEnd := len(input)
+	if i := strings.IndexByte(input[offset:], '\n'); i >= 0 {
+		lineEnd = offset + i
+	}
+
+	return &ParseError{
+		Kind:    kind,
+		Message: fmt.Sprintf(format, args...),
+		Offset:  offset,
+		Line:    strings.Count(input[:offset], "\n") + 1,
+		Column:  utf8.RuneCountInString(input[lineStart:offset]) + 1,
+		Snippet: input[lineStart:lineEnd],
+	}
+}
+
+// UnsetVariableError is returned when Options.NoUnset is set and an expansion uses a variable that
+// isn't set
+type UnsetVariableError struct {
+	Name string
+	Span Span // where in the input the expansion using the variable was parsed from
+}
+
+func (e *UnsetVariableError) Error() string {
+	return fmt.Sprintf("$%s: not set", e.Name)
+}
+
+// StreamError is returned by InterpolateStream when an expansion fails, to say where it was
+type StreamError struct {
+	Offset int // the offset in bytes of the expansion from the start of the stream
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return fmt.Sprintf("%v (at offset %d)", e.Err, e.Offset)
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// ExpansionError is an expansion that failed when expanding with Options.ContinueOnError, and where
+// it was
+type ExpansionError struct {
+	Span Span // where in the input the expansion was parsed from
+	Err  error
+}
+
+func (e *ExpansionError) Error() string {
+	return fmt.Sprintf("%v (at offset %d)", e.Err, e.Span.Start)
+}
+
+func (e *ExpansionError) Unwrap() error {
+	return e.Err
+}
+
+// ExpansionErrors is returned when expanding with Options.ContinueOnError and any expansions failed.
+// It lists them all in the order they're written, including those nested within other expansions.
+// Like an error from errors.Join, errors.Is and errors.As check each of them.
+type ExpansionErrors struct {
+	Errors []*ExpansionError
+}
+
+func (e *ExpansionErrors) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *ExpansionErrors) Unwrap() []error {
+	errs := make([]error, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err
+	}
+	return errs
+}
+
+// addExpansionError adds the error from expanding the item at span to errs, or if it's from
+// expanding nested expressions, the errors from those
+func addExpansionError(errs []*ExpansionError, err error, span Span) []*ExpansionError {
+	var nested *ExpansionErrors
+	if errors.As(err, &nested) {
+		return append(errs, nested.Errors...)
+	}
+	return append(errs, &ExpansionError{Span: span, Err: withSpan(err, span)})
+}
+
+// expansionErrors returns an *ExpansionErrors for errs, or nil if there aren't any
+func expansionErrors(errs []*ExpansionError) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	return &ExpansionErrors{Errors: errs}
+}
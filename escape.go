@@ -0,0 +1,60 @@
+package interpolate
+
+import (
+	"strings"
+)
+
+// Escape escapes s so that interpolating it gives s again, whatever the variables are. Each $ is
+// escaped as $$, and a backslash straight before a $ (which would otherwise escape it) as ${\}.
+func Escape(s string) string {
+	// without a $ there's nothing to escape
+	if !strings.Contains(s, "$") {
+		return s
+	}
+	var buf strings.Builder
+	writeEscaped(&buf, s, false)
+	return buf.String()
+}
+
+// EscapeN escapes s for the given number of rounds of interpolation, so that interpolating it that
+// many times gives s again. With no rounds, s is returned as it is.
+func EscapeN(s string, rounds int) string {
+	for range rounds {
+		s = Escape(s)
+	}
+	return s
+}
+
+// writeEscaped writes s to buf escaped so that interpolating it gives s again. Backslashes only need
+// escaping straight before a $, so beforeDollar says whether what's written after s starts with one.
+func writeEscaped(buf *strings.Builder, s string, beforeDollar bool) {
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '$':
+			buf.WriteString("$$")
+			i++
+
+		case '\\':
+			j := i
+			for j < len(s) && s[j] == '\\' {
+				j++
+			}
+			// pairs of backslashes are left as they are, but an odd one out would escape a $ after it
+			if (j-i)%2 == 1 && ((j < len(s) && s[j] == '$') || (j == len(s) && beforeDollar)) {
+				buf.WriteString(s[i : j-1])
+				buf.WriteString(`${\}`)
+			} else {
+				buf.WriteString(s[i:j])
+			}
+			i = j
+
+		default:
+			j := strings.IndexAny(s[i:], `$\`)
+			if j < 0 {
+				j = len(s) - i
+			}
+			buf.WriteString(s[i : i+j])
+			i += j
+		}
+	}
+}
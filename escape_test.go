@@ -0,0 +1,82 @@
+package interpolate_test
+
+import (
+	"testing"
+
+	"github.com/buildkite/interpolate"
+)
+
+func TestEscape(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`no dollars here \n`, `no dollars here \n`},
+		{`grep 'xi$'`, `grep 'xi$$'`},
+		{`{"image": "${IMAGE:-alpine}"}`, `{"image": "$${IMAGE:-alpine}"}`},
+		{`$env:PATH = "C:\bin;$env:PATH"`, `$$env:PATH = "C:\bin;$$env:PATH"`},
+		{`^\$\d+`, `^${\}$$\d+`},
+		{`\\$HOME \\\$HOME`, `\\$$HOME \\${\}$$HOME`},
+		{`ends with \`, `ends with \`},
+	} {
+		if result := interpolate.Escape(tc.Str); result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestEscapeN(t *testing.T) {
+	t.Parallel()
+
+	str := `echo \$PATH $$ ${HOME}`
+	if result := interpolate.EscapeN(str, 0); result != str {
+		t.Fatalf("Expected no rounds of escaping to leave %q alone, got %q", str, result)
+	}
+
+	escaped := interpolate.EscapeN(str, 3)
+	if escaped != interpolate.Escape(interpolate.Escape(interpolate.Escape(str))) {
+		t.Fatalf("Expected 3 rounds of escaping to be the same as escaping 3 times, got %q", escaped)
+	}
+	for i := 0; i < 3; i++ {
+		var err error
+		if escaped, err = interpolate.Interpolate(nil, escaped); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if escaped != str {
+		t.Fatalf("Expected %q after 3 rounds of interpolation, got %q", str, escaped)
+	}
+}
+
+func FuzzEscape(f *testing.F) {
+	for _, seed := range []string{
+		``, `$`, `$$`, `\`, `\$`, `\\$`, `\\\$$`, `$\`, `${\}`, `$HOME`, `${HOME:-$USER}`, `$((1 + 2))`,
+		`$(date)`, "`date`", `$1 $# $@`, `'$HOME' "$HOME"`, `${`, `}`, "\xff$", `🦀$🦀\`,
+	} {
+		f.Add(seed)
+	}
+
+	environ := interpolate.NewMapEnv(map[string]string{"HOME": "/home/llama", "USER": "llama", "EMPTY": ""})
+
+	f.Fuzz(func(t *testing.T, s string) {
+		result, err := interpolate.Interpolate(environ, interpolate.Escape(s))
+		if err != nil {
+			t.Fatalf("Interpolating Escape(%q) failed: %v", s, err)
+		}
+		if result != s {
+			t.Fatalf("Interpolating Escape(%q) = %q, expected it back", s, result)
+		}
+
+		escaped := interpolate.EscapeN(s, 2)
+		for i := 0; i < 2; i++ {
+			if escaped, err = interpolate.Interpolate(environ, escaped); err != nil {
+				t.Fatalf("Interpolating EscapeN(%q, 2) failed: %v", s, err)
+			}
+		}
+		if escaped != s {
+			t.Fatalf("Interpolating EscapeN(%q, 2) twice = %q, expected it back", s, escaped)
+		}
+	})
+}
@@ -1,20 +1,71 @@
 package interpolate
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Interpolate takes a set of environment and interpolates it into the provided string using shell script expansions
 func Interpolate(env Env, str string) (string, error) {
+	return InterpolateWithOptions(env, str, Options{})
+}
+
+// InterpolateWithOptions is like Interpolate, but with options that change how the string is interpolated
+func InterpolateWithOptions(env Env, str string, opts Options) (string, error) {
 	if env == nil {
 		env = NewSliceEnv(nil)
 	}
-	expr, err := NewParser(str).Parse()
+	expr, err := NewParserWithOptions(str, opts).Parse()
 	if err != nil {
 		return "", err
 	}
-	return expr.Expand(env)
+	return expr.ExpandWithOptions(env, opts)
+}
+
+// Options changes the behaviour of interpolation. The zero value gives the default behaviour.
+type Options struct {
+	// NoArithmetic passes $((expression)) through as text rather than evaluating it, the same as $(command)
+	NoArithmetic bool
+
+	// CommandRunner enables command substitution, so $(command) and `command` are replaced with the
+	// output of running command with it. Otherwise they are passed through as text.
+	CommandRunner CommandRunner
+
+	// RespectQuotes tracks shell quoting like a shell would. Single quoted strings, including $'...'
+	// strings, are left exactly as they are, while double quoted strings are expanded. The quotes
+	// themselves are kept, so the result can still be run by a shell.
+	RespectQuotes bool
+
+	// NoUnset makes expanding a variable that isn't set an error, like set -u in a shell. Expansions
+	// that handle unset variables, like ${VAR:-default} and ${VAR+alternate}, are still allowed.
+	// The error is an *UnsetVariableError.
+	NoUnset bool
+
+	// ContinueOnError keeps expanding after an expansion fails, rather than stopping at the first
+	// error, so every problem (like every missing required variable) can be reported at once. Failed
+	// expansions expand to nothing, and the partial result is returned along with an
+	// *ExpansionErrors listing each failure and where it was.
+	ContinueOnError bool
+}
+
+// CommandRunner runs the commands in command substitutions, like $(git rev-parse HEAD)
+type CommandRunner interface {
+	// RunCommand runs command and returns what it wrote to stdout. The env is the one being used for
+	// interpolation, and may contain values assigned by earlier expansions.
+	RunCommand(command string, env Env) (string, error)
+}
+
+// CommandRunnerFunc adapts an ordinary function to a CommandRunner
+type CommandRunnerFunc func(command string, env Env) (string, error)
+
+func (f CommandRunnerFunc) RunCommand(command string, env Env) (string, error) {
+	return f(command, env)
 }
 
 // Indentifiers parses the identifiers from any expansions in the provided string
@@ -38,6 +89,20 @@ type Expansion interface {
 	Identifiers() []string
 }
 
+// A ParentExpansion is an Expansion that contains other expressions, like the default value in
+// ${VAR:-default}. Walk and Rewrite use it to find the expressions within expansions.
+type ParentExpansion interface {
+	Expansion
+
+	// Children returns the expressions within the expansion, in the order they're written. An
+	// optional expression that's left out, like the replacement in ${VAR/pattern}, is nil.
+	Children() []Expression
+
+	// WithChildren returns a copy of the expansion with its children replaced by the given ones,
+	// which must be in the same order as Children returns them.
+	WithChildren(children []Expression) Expansion
+}
+
 // VariableExpansion represents either $VAR or ${VAR}, our simplest expansion
 type VariableExpansion struct {
 	Identifier string
@@ -47,9 +112,13 @@ func (e VariableExpansion) Identifiers() []string {
 	return []string{e.Identifier}
 }
 
+func (e VariableExpansion) String() string {
+	return "${" + e.Identifier + "}"
+}
+
 func (e VariableExpansion) Expand(env Env) (string, error) {
-	val, _ := env.Get(e.Identifier)
-	return val, nil
+	val, _, err := lookupVariable(env, e.Identifier)
+	return val, err
 }
 
 // EmptyValueExpansion returns either the value of an env, or a default value if it's unset or null
@@ -62,6 +131,19 @@ func (e EmptyValueExpansion) Identifiers() []string {
 	return append([]string{e.Identifier}, e.Content.Identifiers()...)
 }
 
+func (e EmptyValueExpansion) String() string {
+	return braceString(e.Identifier, ":-", e.Content.String())
+}
+
+func (e EmptyValueExpansion) Children() []Expression {
+	return []Expression{e.Content}
+}
+
+func (e EmptyValueExpansion) WithChildren(children []Expression) Expansion {
+	e.Content = children[0]
+	return e
+}
+
 func (e EmptyValueExpansion) Expand(env Env) (string, error) {
 	val, _ := env.Get(e.Identifier)
 	if val == "" {
@@ -80,6 +162,19 @@ func (e UnsetValueExpansion) Identifiers() []string {
 	return []string{e.Identifier}
 }
 
+func (e UnsetValueExpansion) String() string {
+	return braceString(e.Identifier, "-", e.Content.String())
+}
+
+func (e UnsetValueExpansion) Children() []Expression {
+	return []Expression{e.Content}
+}
+
+func (e UnsetValueExpansion) WithChildren(children []Expression) Expansion {
+	e.Content = children[0]
+	return e
+}
+
 func (e UnsetValueExpansion) Expand(env Env) (string, error) {
 	val, ok := env.Get(e.Identifier)
 	if !ok {
@@ -88,6 +183,828 @@ func (e UnsetValueExpansion) Expand(env Env) (string, error) {
 	return val, nil
 }
 
+// AssignDefaultExpansion returns either the value of an env, or assigns a default value to the env and
+// returns it if it's unset (or null, when CheckEmpty is set)
+type AssignDefaultExpansion struct {
+	Identifier string
+	Content    Expression
+	CheckEmpty bool
+}
+
+func (e AssignDefaultExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Content.Identifiers()...)
+}
+
+func (e AssignDefaultExpansion) String() string {
+	if e.CheckEmpty {
+		return braceString(e.Identifier, ":=", e.Content.String())
+	}
+	return braceString(e.Identifier, "=", e.Content.String())
+}
+
+func (e AssignDefaultExpansion) Children() []Expression {
+	return []Expression{e.Content}
+}
+
+func (e AssignDefaultExpansion) WithChildren(children []Expression) Expansion {
+	e.Content = children[0]
+	return e
+}
+
+func (e AssignDefaultExpansion) Expand(env Env) (string, error) {
+	val, ok := env.Get(e.Identifier)
+	if ok && !(e.CheckEmpty && val == "") {
+		return val, nil
+	}
+	mutable, ok := unwrapEnv(env).(MutableEnv)
+	if !ok {
+		return "", fmt.Errorf("$%s: cannot assign in a read-only environment", e.Identifier)
+	}
+	val, err := e.Content.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	mutable.Set(e.Identifier, val)
+	return val, nil
+}
+
+// AlternateValueExpansion returns an alternate value if an env is set (and not null, when CheckEmpty is set),
+// otherwise an empty string
+type AlternateValueExpansion struct {
+	Identifier string
+	Content    Expression
+	CheckEmpty bool
+}
+
+func (e AlternateValueExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Content.Identifiers()...)
+}
+
+func (e AlternateValueExpansion) String() string {
+	if e.CheckEmpty {
+		return braceString(e.Identifier, ":+", e.Content.String())
+	}
+	return braceString(e.Identifier, "+", e.Content.String())
+}
+
+func (e AlternateValueExpansion) Children() []Expression {
+	return []Expression{e.Content}
+}
+
+func (e AlternateValueExpansion) WithChildren(children []Expression) Expansion {
+	e.Content = children[0]
+	return e
+}
+
+func (e AlternateValueExpansion) Expand(env Env) (string, error) {
+	val, ok := env.Get(e.Identifier)
+	if !ok || (e.CheckEmpty && val == "") {
+		return "", nil
+	}
+	return e.Content.Expand(env)
+}
+
+// RemovePrefixExpansion returns the value of an env with the shortest prefix matching a pattern removed
+type RemovePrefixExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e RemovePrefixExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e RemovePrefixExpansion) String() string {
+	return braceString(e.Identifier, "#", e.Pattern.String())
+}
+
+func (e RemovePrefixExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e RemovePrefixExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e RemovePrefixExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return trimPrefixPattern(val, pattern, false), nil
+}
+
+// RemoveLongestPrefixExpansion returns the value of an env with the longest prefix matching a pattern removed
+type RemoveLongestPrefixExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e RemoveLongestPrefixExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e RemoveLongestPrefixExpansion) String() string {
+	return braceString(e.Identifier, "##", e.Pattern.String())
+}
+
+func (e RemoveLongestPrefixExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e RemoveLongestPrefixExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e RemoveLongestPrefixExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return trimPrefixPattern(val, pattern, true), nil
+}
+
+// RemoveSuffixExpansion returns the value of an env with the shortest suffix matching a pattern removed
+type RemoveSuffixExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e RemoveSuffixExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e RemoveSuffixExpansion) String() string {
+	return braceString(e.Identifier, "%", e.Pattern.String())
+}
+
+func (e RemoveSuffixExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e RemoveSuffixExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e RemoveSuffixExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return trimSuffixPattern(val, pattern, false), nil
+}
+
+// RemoveLongestSuffixExpansion returns the value of an env with the longest suffix matching a pattern removed
+type RemoveLongestSuffixExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e RemoveLongestSuffixExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e RemoveLongestSuffixExpansion) String() string {
+	return braceString(e.Identifier, "%%", e.Pattern.String())
+}
+
+func (e RemoveLongestSuffixExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e RemoveLongestSuffixExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e RemoveLongestSuffixExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return trimSuffixPattern(val, pattern, true), nil
+}
+
+// ReplaceExpansion returns the value of an env with the first match of a pattern replaced
+type ReplaceExpansion struct {
+	Identifier  string
+	Pattern     Expression
+	Replacement Expression
+}
+
+func (e ReplaceExpansion) Identifiers() []string {
+	identifiers := append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+	return append(identifiers, e.Replacement.Identifiers()...)
+}
+
+func (e ReplaceExpansion) String() string {
+	return braceString(e.Identifier, "/", replaceString(e.Pattern, e.Replacement))
+}
+
+func (e ReplaceExpansion) Children() []Expression {
+	return []Expression{e.Pattern, e.Replacement}
+}
+
+func (e ReplaceExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern, e.Replacement = children[0], children[1]
+	return e
+}
+
+func (e ReplaceExpansion) Expand(env Env) (string, error) {
+	val, ok, err := lookupVariable(env, e.Identifier)
+	if err != nil || !ok {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	replacement, err := e.Replacement.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return replacePattern(val, pattern, replacement, false), nil
+}
+
+// ReplaceAllExpansion returns the value of an env with every match of a pattern replaced
+type ReplaceAllExpansion struct {
+	Identifier  string
+	Pattern     Expression
+	Replacement Expression
+}
+
+func (e ReplaceAllExpansion) Identifiers() []string {
+	identifiers := append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+	return append(identifiers, e.Replacement.Identifiers()...)
+}
+
+func (e ReplaceAllExpansion) String() string {
+	return braceString(e.Identifier, "//", replaceString(e.Pattern, e.Replacement))
+}
+
+func (e ReplaceAllExpansion) Children() []Expression {
+	return []Expression{e.Pattern, e.Replacement}
+}
+
+func (e ReplaceAllExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern, e.Replacement = children[0], children[1]
+	return e
+}
+
+func (e ReplaceAllExpansion) Expand(env Env) (string, error) {
+	val, ok, err := lookupVariable(env, e.Identifier)
+	if err != nil || !ok {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	replacement, err := e.Replacement.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return replacePattern(val, pattern, replacement, true), nil
+}
+
+// ReplacePrefixExpansion returns the value of an env with a prefix matching a pattern replaced
+type ReplacePrefixExpansion struct {
+	Identifier  string
+	Pattern     Expression
+	Replacement Expression
+}
+
+func (e ReplacePrefixExpansion) Identifiers() []string {
+	identifiers := append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+	return append(identifiers, e.Replacement.Identifiers()...)
+}
+
+func (e ReplacePrefixExpansion) String() string {
+	return braceString(e.Identifier, "/#", replaceString(e.Pattern, e.Replacement))
+}
+
+func (e ReplacePrefixExpansion) Children() []Expression {
+	return []Expression{e.Pattern, e.Replacement}
+}
+
+func (e ReplacePrefixExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern, e.Replacement = children[0], children[1]
+	return e
+}
+
+func (e ReplacePrefixExpansion) Expand(env Env) (string, error) {
+	val, ok, err := lookupVariable(env, e.Identifier)
+	if err != nil || !ok {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	replacement, err := e.Replacement.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return replacePrefixPattern(val, pattern, replacement), nil
+}
+
+// ReplaceSuffixExpansion returns the value of an env with a suffix matching a pattern replaced
+type ReplaceSuffixExpansion struct {
+	Identifier  string
+	Pattern     Expression
+	Replacement Expression
+}
+
+func (e ReplaceSuffixExpansion) Identifiers() []string {
+	identifiers := append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+	return append(identifiers, e.Replacement.Identifiers()...)
+}
+
+func (e ReplaceSuffixExpansion) String() string {
+	return braceString(e.Identifier, "/%", replaceString(e.Pattern, e.Replacement))
+}
+
+func (e ReplaceSuffixExpansion) Children() []Expression {
+	return []Expression{e.Pattern, e.Replacement}
+}
+
+func (e ReplaceSuffixExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern, e.Replacement = children[0], children[1]
+	return e
+}
+
+func (e ReplaceSuffixExpansion) Expand(env Env) (string, error) {
+	val, ok, err := lookupVariable(env, e.Identifier)
+	if err != nil || !ok {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	replacement, err := e.Replacement.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return replaceSuffixPattern(val, pattern, replacement), nil
+}
+
+// LengthExpansion returns the length of the value of an env, in characters
+type LengthExpansion struct {
+	Identifier string
+}
+
+func (e LengthExpansion) Identifiers() []string {
+	return []string{e.Identifier}
+}
+
+func (e LengthExpansion) String() string {
+	return "${#" + e.Identifier + "}"
+}
+
+func (e LengthExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Itoa(utf8.RuneCountInString(val)), nil
+}
+
+// UppercaseFirstExpansion returns the value of an env with its first character converted to uppercase if it matches a pattern
+type UppercaseFirstExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e UppercaseFirstExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e UppercaseFirstExpansion) String() string {
+	return braceString(e.Identifier, "^", e.Pattern.String())
+}
+
+func (e UppercaseFirstExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e UppercaseFirstExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e UppercaseFirstExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return convertCase(val, pattern, unicode.ToUpper, false), nil
+}
+
+// UppercaseAllExpansion returns the value of an env with every character that matches a pattern converted to uppercase
+type UppercaseAllExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e UppercaseAllExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e UppercaseAllExpansion) String() string {
+	return braceString(e.Identifier, "^^", e.Pattern.String())
+}
+
+func (e UppercaseAllExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e UppercaseAllExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e UppercaseAllExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return convertCase(val, pattern, unicode.ToUpper, true), nil
+}
+
+// LowercaseFirstExpansion returns the value of an env with its first character converted to lowercase if it matches a pattern
+type LowercaseFirstExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e LowercaseFirstExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e LowercaseFirstExpansion) String() string {
+	return braceString(e.Identifier, ",", e.Pattern.String())
+}
+
+func (e LowercaseFirstExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e LowercaseFirstExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e LowercaseFirstExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return convertCase(val, pattern, unicode.ToLower, false), nil
+}
+
+// LowercaseAllExpansion returns the value of an env with every character that matches a pattern converted to lowercase
+type LowercaseAllExpansion struct {
+	Identifier string
+	Pattern    Expression
+}
+
+func (e LowercaseAllExpansion) Identifiers() []string {
+	return append([]string{e.Identifier}, e.Pattern.Identifiers()...)
+}
+
+func (e LowercaseAllExpansion) String() string {
+	return braceString(e.Identifier, ",,", e.Pattern.String())
+}
+
+func (e LowercaseAllExpansion) Children() []Expression {
+	return []Expression{e.Pattern}
+}
+
+func (e LowercaseAllExpansion) WithChildren(children []Expression) Expansion {
+	e.Pattern = children[0]
+	return e
+}
+
+func (e LowercaseAllExpansion) Expand(env Env) (string, error) {
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
+	pattern, err := e.Pattern.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	return convertCase(val, pattern, unicode.ToLower, true), nil
+}
+
+// IndirectExpansion returns the value of the env named by the value of another env
+type IndirectExpansion struct {
+	Identifier string
+}
+
+func (e IndirectExpansion) Identifiers() []string {
+	return []string{e.Identifier}
+}
+
+func (e IndirectExpansion) String() string {
+	return "${!" + e.Identifier + "}"
+}
+
+func (e IndirectExpansion) Expand(env Env) (string, error) {
+	name, ok := env.Get(e.Identifier)
+	if !ok {
+		return "", fmt.Errorf("$%s: invalid indirect expansion, not set", e.Identifier)
+	}
+	if !isIdentifier(name) {
+		return "", fmt.Errorf("$%s: invalid indirect expansion, %q is not a valid variable name", e.Identifier, name)
+	}
+	val, _ := env.Get(name)
+	return val, nil
+}
+
+// PrefixNamesExpansion returns the names of all envs that start with a prefix, separated by spaces
+type PrefixNamesExpansion struct {
+	Prefix string
+	// At is set for ${!PREFIX@} rather than ${!PREFIX*}, which expand the same way outside of a shell
+	At bool
+}
+
+func (e PrefixNamesExpansion) Identifiers() []string {
+	return []string{}
+}
+
+func (e PrefixNamesExpansion) String() string {
+	if e.At {
+		return "${!" + e.Prefix + "@}"
+	}
+	return "${!" + e.Prefix + "*}"
+}
+
+func (e PrefixNamesExpansion) Expand(env Env) (string, error) {
+	enumerable, ok := unwrapEnv(env).(EnumerableEnv)
+	if !ok {
+		op := "*"
+		if e.At {
+			op = "@"
+		}
+		return "", fmt.Errorf("${!%s%s}: cannot list variable names, the environment is not enumerable", e.Prefix, op)
+	}
+	var names []string
+	for _, key := range enumerable.Keys() {
+		if strings.HasPrefix(key, e.Prefix) {
+			names = append(names, key)
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " "), nil
+}
+
+// TransformOperator is the operator character of a TransformExpansion, such as the Q in ${VAR@Q}
+type TransformOperator rune
+
+const (
+	// TransformQuote quotes the value so it can be reused as shell input
+	TransformQuote TransformOperator = 'Q'
+	// TransformEscape expands backslash escape sequences in the value, as in $'...' strings
+	TransformEscape TransformOperator = 'E'
+	// TransformUppercase converts the value to uppercase
+	TransformUppercase TransformOperator = 'U'
+	// TransformUppercaseFirst converts the first character of the value to uppercase
+	TransformUppercaseFirst TransformOperator = 'u'
+	// TransformLowercase converts the value to lowercase
+	TransformLowercase TransformOperator = 'L'
+	// TransformAssignment returns a shell assignment statement that would recreate the env
+	TransformAssignment TransformOperator = 'A'
+)
+
+// TransformExpansion returns the value of an env transformed by an operator, like ${VAR@Q}
+type TransformExpansion struct {
+	Identifier string
+	Operator   TransformOperator
+}
+
+func (e TransformExpansion) Identifiers() []string {
+	return []string{e.Identifier}
+}
+
+func (e TransformExpansion) String() string {
+	return braceString(e.Identifier, "@", string(e.Operator))
+}
+
+func (e TransformExpansion) Expand(env Env) (string, error) {
+	val, ok, err := lookupVariable(env, e.Identifier)
+	if err != nil || !ok {
+		return "", err
+	}
+
+	switch e.Operator {
+	case TransformQuote:
+		return shellQuote(val), nil
+	case TransformEscape:
+		return expandEscapes(val), nil
+	case TransformUppercase:
+		return convertCase(val, "", unicode.ToUpper, true), nil
+	case TransformUppercaseFirst:
+		return convertCase(val, "", unicode.ToUpper, false), nil
+	case TransformLowercase:
+		return convertCase(val, "", unicode.ToLower, true), nil
+	case TransformAssignment:
+		return e.Identifier + "=" + shellQuote(val), nil
+	default:
+		return "", fmt.Errorf("$%s: unknown transformation operator %c", e.Identifier, e.Operator)
+	}
+}
+
+// ArithmeticExpansion returns the result of evaluating an arithmetic expression, like $((VAR + 1))
+type ArithmeticExpansion struct {
+	Content Expression
+}
+
+func (e ArithmeticExpansion) Identifiers() []string {
+	identifiers := []string{}
+	for _, item := range e.Content {
+		if item.Expansion != nil {
+			identifiers = append(identifiers, item.Expansion.Identifiers()...)
+		} else {
+			names, _ := arithmeticIdentifiers(item.Text)
+			identifiers = append(identifiers, names...)
+		}
+	}
+	return identifiers
+}
+
+func (e ArithmeticExpansion) String() string {
+	return "$((" + e.Content.String() + "))"
+}
+
+func (e ArithmeticExpansion) Children() []Expression {
+	return []Expression{e.Content}
+}
+
+func (e ArithmeticExpansion) WithChildren(children []Expression) Expansion {
+	e.Content = children[0]
+	return e
+}
+
+func (e ArithmeticExpansion) Expand(env Env) (string, error) {
+	expr, err := e.Content.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	val, err := evaluateArithmetic(env, expr)
+	if err != nil {
+		return "", fmt.Errorf("$((%s)): %w", expr, err)
+	}
+	return strconv.FormatInt(val, 10), nil
+}
+
+// CommandExpansion returns the output of running a command, like $(command) or `command`
+type CommandExpansion struct {
+	Command string
+	// Backquoted is set for the `command` form, rather than $(command)
+	Backquoted bool
+}
+
+func (e CommandExpansion) Identifiers() []string {
+	return []string{}
+}
+
+func (e CommandExpansion) String() string {
+	if e.Backquoted {
+		// backslashes before $, ` and \ were removed from the command when it was parsed, so they need
+		// putting back. Escaping $ isn't needed, as it's left alone either way.
+		var buf strings.Builder
+		buf.WriteByte('`')
+		for i := 0; i < len(e.Command); i++ {
+			if c := e.Command[i]; c == '`' || (c == '\\' && (i+1 == len(e.Command) || strings.IndexByte("`\\$", e.Command[i+1]) >= 0)) {
+				buf.WriteByte('\\')
+			}
+			buf.WriteByte(e.Command[i])
+		}
+		buf.WriteByte('`')
+		return buf.String()
+	}
+	return "$(" + e.Command + ")"
+}
+
+func (e CommandExpansion) Expand(env Env) (string, error) {
+	runner := optionsOf(env).CommandRunner
+	if runner == nil {
+		return "", fmt.Errorf("$(%s): command substitution requires a CommandRunner", e.Command)
+	}
+	out, err := runner.RunCommand(e.Command, unwrapEnv(env))
+	if err != nil {
+		return "", fmt.Errorf("$(%s): %w", e.Command, err)
+	}
+	// like a shell, trailing newlines are removed from the output
+	return strings.TrimRight(out, "\n"), nil
+}
+
+// PositionalExpansion returns a positional argument, like $1 or ${10}. If the env doesn't have
+// arguments it returns itself as text, so strings like $1.00 are left alone.
+type PositionalExpansion struct {
+	Index  int
+	Braced bool
+}
+
+func (e PositionalExpansion) Identifiers() []string {
+	return []string{}
+}
+
+func (e PositionalExpansion) String() string {
+	if e.Braced || e.Index > 9 {
+		return "${" + strconv.Itoa(e.Index) + "}"
+	}
+	return "$" + strconv.Itoa(e.Index)
+}
+
+func (e PositionalExpansion) Expand(env Env) (string, error) {
+	argsEnv, ok := unwrapEnv(env).(ArgsEnv)
+	if !ok {
+		if e.Braced {
+			return "${" + strconv.Itoa(e.Index) + "}", nil
+		}
+		return "$" + strconv.Itoa(e.Index), nil
+	}
+	args := argsEnv.Args()
+	if e.Index < 1 || e.Index > len(args) {
+		if optionsOf(env).NoUnset {
+			return "", &UnsetVariableError{Name: strconv.Itoa(e.Index)}
+		}
+		return "", nil
+	}
+	return args[e.Index-1], nil
+}
+
+// SpecialExpansion returns the number of positional arguments for $#, or all of them separated by
+// spaces for $@ and $*. If the env doesn't have arguments it returns itself as text.
+type SpecialExpansion struct {
+	Name   rune
+	Braced bool
+}
+
+func (e SpecialExpansion) Identifiers() []string {
+	return []string{}
+}
+
+func (e SpecialExpansion) String() string {
+	if e.Braced {
+		return "${" + string(e.Name) + "}"
+	}
+	return "$" + string(e.Name)
+}
+
+func (e SpecialExpansion) Expand(env Env) (string, error) {
+	argsEnv, ok := unwrapEnv(env).(ArgsEnv)
+	if !ok {
+		if e.Braced {
+			return "${" + string(e.Name) + "}", nil
+		}
+		return "$" + string(e.Name), nil
+	}
+	args := argsEnv.Args()
+	switch e.Name {
+	case '#':
+		return strconv.Itoa(len(args)), nil
+	case '@', '*':
+		return strings.Join(args, " "), nil
+	default:
+		return "", fmt.Errorf("$%c: unknown special parameter", e.Name)
+	}
+}
+
 // EscapedExpansion is an expansion that is delayed until later on (usually by a later process)
 type EscapedExpansion struct {
 	// PotentialIdentifier is an identifier for the purpose of Identifiers,
@@ -99,10 +1016,47 @@ func (e EscapedExpansion) Identifiers() []string {
 	return []string{"$" + e.PotentialIdentifier}
 }
 
+func (e EscapedExpansion) String() string {
+	// the potential identifier is parsed again as text after the escape, so isn't part of it
+	return "$$"
+}
+
 func (e EscapedExpansion) Expand(Env) (string, error) {
 	return "$", nil
 }
 
+// EscapedBackslashExpansion is a single backslash, written as ${\}. It's only needed straight before
+// a $, where a backslash written as it is would escape the $ instead.
+type EscapedBackslashExpansion struct{}
+
+func (e EscapedBackslashExpansion) Identifiers() []string {
+	return nil
+}
+
+func (e EscapedBackslashExpansion) String() string {
+	return `${\}`
+}
+
+func (e EscapedBackslashExpansion) Expand(Env) (string, error) {
+	return `\`, nil
+}
+
+// EscapedBackquoteExpansion is a backquote escaped as \`, which is only parsed with a CommandRunner,
+// where a backquote would otherwise start a command substitution
+type EscapedBackquoteExpansion struct{}
+
+func (e EscapedBackquoteExpansion) Identifiers() []string {
+	return nil
+}
+
+func (e EscapedBackquoteExpansion) String() string {
+	return "\\`"
+}
+
+func (e EscapedBackquoteExpansion) Expand(Env) (string, error) {
+	return "`", nil
+}
+
 // SubstringExpansion returns a substring (or slice) of the env
 type SubstringExpansion struct {
 	Identifier string
@@ -115,8 +1069,23 @@ func (e SubstringExpansion) Identifiers() []string {
 	return []string{e.Identifier}
 }
 
+func (e SubstringExpansion) String() string {
+	// a space keeps a negative offset from looking like ${VAR:-default}
+	str := ": " + strconv.Itoa(e.Offset)
+	if e.Offset >= 0 {
+		str = ":" + strconv.Itoa(e.Offset)
+	}
+	if e.HasLength {
+		str += ":" + strconv.Itoa(e.Length)
+	}
+	return "${" + e.Identifier + str + "}"
+}
+
 func (e SubstringExpansion) Expand(env Env) (string, error) {
-	val, _ := env.Get(e.Identifier)
+	val, _, err := lookupVariable(env, e.Identifier)
+	if err != nil {
+		return "", err
+	}
 
 	from := e.Offset
 
@@ -162,29 +1131,50 @@ func (e SubstringExpansion) Expand(env Env) (string, error) {
 	return val[from:to], nil
 }
 
-// RequiredExpansion returns an env value, or an error if it is unset
+// RequiredExpansion returns an env value, or an error if it is unset (or null, when CheckEmpty is set)
 type RequiredExpansion struct {
 	Identifier string
 	Message    Expression
+	CheckEmpty bool
 }
 
 func (e RequiredExpansion) Identifiers() []string {
 	return []string{e.Identifier}
 }
 
+func (e RequiredExpansion) String() string {
+	if e.CheckEmpty {
+		return braceString(e.Identifier, ":?", e.Message.String())
+	}
+	return braceString(e.Identifier, "?", e.Message.String())
+}
+
+func (e RequiredExpansion) Children() []Expression {
+	return []Expression{e.Message}
+}
+
+func (e RequiredExpansion) WithChildren(children []Expression) Expansion {
+	e.Message = children[0]
+	return e
+}
+
 func (e RequiredExpansion) Expand(env Env) (string, error) {
 	val, ok := env.Get(e.Identifier)
-	if !ok {
-		msg, err := e.Message.Expand(env)
-		if err != nil {
-			return "", err
-		}
-		if msg == "" {
+	if ok && !(e.CheckEmpty && val == "") {
+		return val, nil
+	}
+	msg, err := e.Message.Expand(env)
+	if err != nil {
+		return "", err
+	}
+	if msg == "" {
+		if ok {
+			msg = "set but empty"
+		} else {
 			msg = "not set"
 		}
-		return "", fmt.Errorf("$%s: %s", e.Identifier, msg)
 	}
-	return val, nil
+	return "", fmt.Errorf("$%s: %s", e.Identifier, msg)
 }
 
 // Expression is a collection of either Text or Expansions
@@ -200,14 +1190,52 @@ func (e Expression) Identifiers() []string {
 	return identifiers
 }
 
+// ExpandWithOptions is like Expand, but with options that change how expansions behave
+func (e Expression) ExpandWithOptions(env Env, opts Options) (string, error) {
+	return e.Expand(withOptions(env, opts))
+}
+
+// String returns the expression as it would be written in a template, so that parsing it again gives
+// the same expression. Variables are written as $VAR where that's unambiguous, and as ${VAR} otherwise.
+func (e Expression) String() string {
+	var buf strings.Builder
+
+	for i, item := range e {
+		// $$ would join up with a $ written before it, so the other escape is used instead
+		if _, ok := item.Expansion.(EscapedExpansion); ok && strings.HasSuffix(buf.String(), "$") {
+			buf.WriteString(`\$`)
+			continue
+		}
+		if ve, ok := item.Expansion.(VariableExpansion); ok && isIdentifier(ve.Identifier) {
+			// braces are only needed if the text after the variable would become part of its name
+			next := ""
+			if i+1 < len(e) && e[i+1].Expansion == nil {
+				next = e[i+1].Text
+			}
+			if r, _ := utf8.DecodeRuneInString(next); next == "" || !isIdentifierRune(r) {
+				buf.WriteString("$" + ve.Identifier)
+				continue
+			}
+		}
+		buf.WriteString(item.String())
+	}
+
+	return buf.String()
+}
+
 func (e Expression) Expand(env Env) (string, error) {
 	var buf strings.Builder
+	var errs []*ExpansionError
+	continueOnError := optionsOf(env).ContinueOnError
 
 	for _, item := range e {
 		if item.Expansion != nil {
 			result, err := item.Expansion.Expand(env)
 			if err != nil {
-				return "", err
+				if !continueOnError {
+					return "", withSpan(err, item.Span)
+				}
+				errs = addExpansionError(errs, err, item.Span)
 			}
 			buf.WriteString(result)
 		} else {
@@ -215,7 +1243,51 @@ func (e Expression) Expand(env Env) (string, error) {
 		}
 	}
 
-	return buf.String(), nil
+	return buf.String(), expansionErrors(errs)
+}
+
+// expandTo is like Expand, but writes the result of each item to w as it goes
+func (e Expression) expandTo(w io.Writer, env Env) error {
+	var errs []*ExpansionError
+	continueOnError := optionsOf(env).ContinueOnError
+
+	for _, item := range e {
+		text := item.Text
+		if item.Expansion != nil {
+			result, err := item.Expansion.Expand(env)
+			if err != nil {
+				if !continueOnError {
+					return withSpan(err, item.Span)
+				}
+				errs = addExpansionError(errs, err, item.Span)
+			}
+			text = result
+		}
+		if _, err := io.WriteString(w, text); err != nil {
+			return err
+		}
+	}
+	return expansionErrors(errs)
+}
+
+// lookupVariable gets the value of a variable for an expansion that uses it as it is. With
+// Options.NoUnset, it's an error for the variable not to be set.
+func lookupVariable(env Env, name string) (string, bool, error) {
+	val, ok := env.Get(name)
+	if !ok && optionsOf(env).NoUnset {
+		return "", false, &UnsetVariableError{Name: name}
+	}
+	return val, ok, nil
+}
+
+// withSpan adds the span of the item an error came from to an *UnsetVariableError, unless it already
+// has one from a more deeply nested item
+func withSpan(err error, span Span) error {
+	var unsetErr *UnsetVariableError
+	if errors.As(err, &unsetErr) && unsetErr.Span == (Span{}) {
+		unsetErr.Span = span
+	}
+	return err
 }
 
 // ExpressionItem models either an Expansion or Text. Either/Or, never both.
@@ -223,11 +1295,41 @@ type ExpressionItem struct {
 	Text string
 	// -- or --
 	Expansion Expansion
+
+	// Span is where the item was parsed from in the input
+	Span Span
 }
 
+// Span is a range of the input to a Parser, as byte offsets from the start of it. Start is the first
+// byte in the range and End is the byte after the last one, so input[span.Start:span.End] is the text
+// that was parsed.
+type Span struct {
+	Start, End int
+}
+
+// String returns the item as it would be written in a template. Text is returned as it is, as the
+// parser keeps it the same as it was in the input. The one exception is an escaped backquote with
+// command substitution, which is unescaped by the parser.
 func (i ExpressionItem) String() string {
-	if i.Expansion != nil {
-		return fmt.Sprintf("%#v", i.Expansion)
+	if i.Expansion == nil {
+		return i.Text
+	}
+	if s, ok := i.Expansion.(fmt.Stringer); ok {
+		return s.String()
+	}
+	return fmt.Sprintf("%#v", i.Expansion)
+}
+
+// braceString returns the source for a brace expansion like ${VAR:-word}
+func braceString(identifier, operator, word string) string {
+	return "${" + identifier + operator + word + "}"
+}
+
+// replaceString returns the source for the pattern and replacement of a replace expansion, leaving out
+// the replacement if there isn't one
+func replaceString(pattern, replacement Expression) string {
+	if replacement == nil {
+		return pattern.String()
 	}
-	return fmt.Sprintf("%q", i.Text)
+	return pattern.String() + "/" + replacement.String()
 }
@@ -1,9 +1,11 @@
 package interpolate_test
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/buildkite/interpolate"
@@ -49,6 +51,7 @@ func TestBasicInterpolation(t *testing.T) {
 		{`my$TEST1`, `myA test`},
 		{`$TEST4`, "Only one level of $TEST3 interpolation"},
 		{`${TEST4}`, "Only one level of $TEST3 interpolation"},
+		{"\xff$TEST3\xfe\xfd", "\xffLlamas\xfe\xfd"},
 	} {
 		t.Run(tc.Str, func(t *testing.T) {
 			t.Parallel()
@@ -103,6 +106,9 @@ func TestIgnoresParentheses(t *testing.T) {
 		`$(echo hello world)`,
 		`testing $(echo hello world)`,
 		`$(`,
+		`$((echo hello); (echo world))`,
+		`$((`,
+		"`echo hello world`",
 	} {
 		result, err := interpolate.Interpolate(nil, str)
 		if err != nil {
@@ -243,9 +249,776 @@ func TestDefaultValues(t *testing.T) {
 	}
 }
 
+func TestAssignDefaultValues(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`Today is ${TODAY=Tuesday}, still ${TODAY}`, `Today is Tuesday, still Tuesday`},
+		{`Today is ${DAY=Wednesday}`, `Today is Blarghday`},
+		{`Today is ${EMPTY_DAY=Wednesday}, still $EMPTY_DAY`, `Today is , still `},
+		{`Today is ${EMPTY_DAY:=Wednesday}, still $EMPTY_DAY`, `Today is Wednesday, still Wednesday`},
+		{`${EMPTY:=${LLAMAS=test}} $EMPTY $LLAMAS`, `test test test`},
+		{`${EMPTY:=} ${EMPTY-unset}`, ` `},
+	} {
+		environ := interpolate.NewMapEnv(map[string]string{
+			"DAY":       "Blarghday",
+			"EMPTY_DAY": "",
+		})
+
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestAlternateValues(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"BUILDKITE_BRANCH": "main",
+		"EMPTY":            "",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`deploy ${BUILDKITE_BRANCH:+--branch=$BUILDKITE_BRANCH}`, `deploy --branch=main`},
+		{`deploy ${BUILDKITE_TAG:+--tag=$BUILDKITE_TAG}`, `deploy `},
+		{`deploy ${EMPTY:+--empty}`, `deploy `},
+		{`deploy ${EMPTY+--empty}`, `deploy --empty`},
+		{`deploy ${BUILDKITE_TAG+--tag}`, `deploy `},
+		{`${BUILDKITE_BRANCH:+${EMPTY:-nested}}`, `nested`},
+		{`${BUILDKITE_BRANCH+}`, ``},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestRemovingPatterns(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"BUILDKITE_BRANCH": "refs/heads/feature/llamas",
+		"FILE":             "build/output.tar.gz",
+		"EXTENSION":        ".gz",
+		"EMOJI":            "🦀🦙🦀",
+		"EMPTY":            "",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`${BUILDKITE_BRANCH#refs/heads/}`, `feature/llamas`},
+		{`${BUILDKITE_BRANCH#*/}`, `heads/feature/llamas`},
+		{`${BUILDKITE_BRANCH##*/}`, `llamas`},
+		{`${FILE%.*}`, `build/output.tar`},
+		{`${FILE%%.*}`, `build/output`},
+		{`${FILE%.tar.gz}`, `build/output`},
+		{`${FILE##*[/.]}`, `gz`},
+		{`${FILE#[!b]*}`, `build/output.tar.gz`},
+		{`${FILE#?????}`, `/output.tar.gz`},
+		{`${FILE%%[[:punct:]]*}`, `build`},
+		{`${FILE#build\/}`, `output.tar.gz`},
+		{`${FILE#nomatch}`, `build/output.tar.gz`},
+		{`${FILE%$EXTENSION}`, `build/output.tar`},
+		{`${FILE%${UNSET:-.tar}$EXTENSION}`, `build/output`},
+		{`${EMOJI#?}`, `🦙🦀`},
+		{`${EMOJI%%🦙*}`, `🦀`},
+		{`${EMPTY#*}`, ``},
+		{`${UNSET%%*}`, ``},
+		{`${FILE#}`, `build/output.tar.gz`},
+		{`${FILE##}`, `build/output.tar.gz`},
+		{`${FILE%*}`, `build/output.tar.gz`},
+		{`${FILE%%*}`, ``},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestReplacingPatterns(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"BUILDKITE_BRANCH": "feature/some/branch",
+		"LETTERS":          "abcabc",
+		"SEPARATOR":        "-",
+		"EMOJI":            "🦀🦙🦀",
+		"EMPTY":            "",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`${BUILDKITE_BRANCH//\//-}`, `feature-some-branch`},
+		{`${BUILDKITE_BRANCH/\//-}`, `feature-some/branch`},
+		{`${BUILDKITE_BRANCH//\//$SEPARATOR}`, `feature-some-branch`},
+		{`${BUILDKITE_BRANCH//\//${UNSET:-_}}`, `feature_some_branch`},
+		{`${BUILDKITE_BRANCH/#feature\//}`, `some/branch`},
+		{`${BUILDKITE_BRANCH/%branch/leaf}`, `feature/some/leaf`},
+		{`${BUILDKITE_BRANCH/%bra/leaf}`, `feature/some/branch`},
+		{`${BUILDKITE_BRANCH/#some/x}`, `feature/some/branch`},
+		{`${LETTERS//b/}`, `acac`},
+		{`${LETTERS/b}`, `acabc`},
+		{`${LETTERS//}`, `abcabc`},
+		{`${LETTERS/#/R}`, `Rabcabc`},
+		{`${LETTERS/%/R}`, `abcabcR`},
+		{`${LETTERS//*/R}`, `R`},
+		{`${LETTERS//?/R}`, `RRRRRR`},
+		{`${LETTERS//[ac]/.}`, `.b..b.`},
+		{`${LETTERS/b*/R}`, `aR`},
+		{`${LETTERS//c/$SEPARATOR}`, `ab-ab-`},
+		{`${LETTERS/a/x/y}`, `x/ybcabc`},
+		{`${LETTERS//a/\/}`, `/bc/bc`},
+		{`${LETTERS//a/x\/y}`, `x/ybcx/ybc`},
+		{`${LETTERS//a/\\/}`, `\\/bc\\/bc`},
+		{`${BUILDKITE_BRANCH//\//\/}`, `feature/some/branch`},
+		{`${LETTERS//%/R}`, `abcabc`},
+		{`${LETTERS//#a/R}`, `abcabc`},
+		{`${LETTERS//$SEPARATOR/R}`, `abcabc`},
+		{`${EMOJI//🦀/🦞}`, `🦞🦙🦞`},
+		{`${EMOJI/?/.}`, `.🦙🦀`},
+		{`${EMPTY//*/R}`, `R`},
+		{`${EMPTY/#/R}`, `R`},
+		{`${EMPTY//x/R}`, ``},
+		{`${UNSET//*/R}`, ``},
+		{`${UNSET/#/R}`, ``},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestPatternsOnLongValues(t *testing.T) {
+	t.Parallel()
+
+	msg := strings.Repeat(`say "hi" `, 2500)
+	letters := strings.Repeat("a", 3000)
+	environ := interpolate.NewMapEnv(map[string]string{
+		"MSG":     msg,
+		"LETTERS": letters,
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`${MSG//\"/}`, strings.Repeat(`say hi `, 2500)},
+		{`${MSG/#*\"/x}`, `x `},
+		{`${MSG#*x}`, msg},
+		{`${MSG%%\"*}`, `say `},
+		{`${LETTERS//*b/x}`, letters},
+		{`${LETTERS//a*b/x}`, letters},
+		{`${LETTERS//a?/x}`, strings.Repeat("x", 1500)},
+		{`${LETTERS/%?*b/x}`, letters},
+		{`${LETTERS//a*b*a/x}`, letters},
+		{`${LETTERS/a*b*a/x}`, letters},
+		{`${LETTERS#a*b*a}`, letters},
+		{`${LETTERS%%a*b*a}`, letters},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestLengths(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"BUILDKITE_COMMIT": "1adf998e39f647b4b25842f107c6ed9d30a3a7c7",
+		"EMOJI":            "🦀🦙",
+		"ACCENTED":         "café",
+		"EMPTY":            "",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`${#BUILDKITE_COMMIT}`, `40`},
+		{`${#EMOJI}`, `2`},
+		{`${#ACCENTED}`, `4`},
+		{`${#EMPTY}`, `0`},
+		{`${#UNSET}`, `0`},
+		{`${UNSET:-${#EMOJI}}`, `2`},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestConvertingCase(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"GREETING": "hello",
+		"SCHOOL":   "ÉCOLE straße",
+		"PATTERN":  "[aeiou]",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`${GREETING^}`, `Hello`},
+		{`${GREETING^^}`, `HELLO`},
+		{`${GREETING^^[aeiou]}`, `hEllO`},
+		{`${GREETING^[aeiou]}`, `hello`},
+		{`${GREETING^^[h-l]}`, `HeLLo`},
+		{`${GREETING^^$PATTERN}`, `hEllO`},
+		{`${GREETING^^?}`, `HELLO`},
+		{`${SCHOOL,}`, `éCOLE straße`},
+		{`${SCHOOL,,}`, `école straße`},
+		{`${SCHOOL^^}`, `ÉCOLE STRAßE`},
+		{`${UNSET^^}`, ``},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestIndirectExpansions(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"TARGET_ENV":  "STAGING_URL",
+		"STAGING_URL": "https://staging.example.com",
+		"MISSING_ENV": "PRODUCTION_URL",
+		"BK_B":        "2",
+		"BK_A":        "1",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`${!TARGET_ENV}`, `https://staging.example.com`},
+		{`${!MISSING_ENV}`, ``},
+		{`${UNSET:-${!TARGET_ENV}}`, `https://staging.example.com`},
+		{`${!BK*}`, `BK_A BK_B`},
+		{`${!BK@}`, `BK_A BK_B`},
+		{`${!NOPE*}`, ``},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestIndirectExpansionErrors(t *testing.T) {
+	t.Parallel()
+
+	environ := readOnlyEnv{
+		"EMPTY":   "",
+		"INVALID": "not valid",
+	}
+
+	for _, tc := range []struct {
+		Str         string
+		ExpectedErr string
+	}{
+		{`${!UNSET}`, `$UNSET: invalid indirect expansion, not set`},
+		{`${!EMPTY}`, `$EMPTY: invalid indirect expansion, "" is not a valid variable name`},
+		{`${!INVALID}`, `$INVALID: invalid indirect expansion, "not valid" is not a valid variable name`},
+		{`${!BK*}`, `${!BK*}: cannot list variable names, the environment is not enumerable`},
+		{`${!BK@}`, `${!BK@}: cannot list variable names, the environment is not enumerable`},
+	} {
+		_, err := interpolate.Interpolate(environ, tc.Str)
+		if err == nil || err.Error() != tc.ExpectedErr {
+			t.Fatalf("Test %q should have failed with error %q, got %v", tc.Str, tc.ExpectedErr, err)
+		}
+	}
+}
+
+func TestTransformations(t *testing.T) {
+	t.Parallel()
+
+	// Expected values are the output of bash 5.2 in a UTF-8 locale
+	for _, tc := range []struct {
+		Str      string
+		Value    string
+		Expected string
+	}{
+		{`${VALUE@Q}`, "", `''`},
+		{`${VALUE@Q}`, "abc", `'abc'`},
+		{`${VALUE@Q}`, "it's", `'it'\''s'`},
+		{`${VALUE@Q}`, "a\nb", `$'a\nb'`},
+		{`${VALUE@Q}`, "\x1b[0m", `$'\E[0m'`},
+		{`${VALUE@Q}`, "\x7f", `$'\177'`},
+		{`${VALUE@Q}`, "a\xffb", `$'a\377b'`},
+		{`${VALUE@Q}`, "\u200b", "'\u200b'"},
+		{`${VALUE@Q}`, "\u0085", `$'\302\205'`},
+		{`${VALUE@Q}`, `\back`, `'\back'`},
+		{`${VALUE@Q}`, "\a\b\f\v\r\t", `$'\a\b\f\v\r\t'`},
+		{`${VALUE@Q}`, "quote'\x01", `$'quote\'\001'`},
+		{`${VALUE@Q}`, "é🦀", `'é🦀'`},
+		{`${VALUE@Q}`, "é\x01", `$'é\001'`},
+		{`${VALUE@Q}`, "$HOME `x` \"y\"", `'$HOME ` + "`x`" + ` "y"'`},
+		{`${VALUE@A}`, "hi", `VALUE='hi'`},
+		{`${VALUE@A}`, "a\nb", `VALUE=$'a\nb'`},
+		{`${VALUE@E}`, `a\tb\nc\x41\101é\cA\q\\z\e\E\'\"\?`, "a\tb\ncAAé\x01\\q\\z\x1b\x1b'\"?"},
+		{`${VALUE@E}`, `\U0001F980 \x4 \u4 \777 \c? \x \u`, "🦀 \x04 \x04 \xff \x7f \\x \\u"},
+		{`${VALUE@E}`, `\ud800|\U110000|\x41g|\101a|\0101`, "\xed\xa0\x80|\xf4\x90\x80\x80|Ag|Aa|\b1"},
+		{`${VALUE@E}`, `a\0b`, "a"},
+		{`${VALUE@E}`, `\c`, `\c`},
+		{`${VALUE@E}`, `x\`, `x\`},
+		{`${VALUE@u}`, "éa b", "Éa b"},
+		{`${VALUE@U}`, "hello world", "HELLO WORLD"},
+		{`${VALUE@L}`, "HELLO World", "hello world"},
+		{`${UNSET@Q}${UNSET@A}${UNSET@E}${UNSET@U}`, "", ""},
+	} {
+		environ := interpolate.NewMapEnv(map[string]string{"VALUE": tc.Value})
+
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q with value %q failed: Expected substring %q, got %q", tc.Str, tc.Value, tc.Expected, result)
+		}
+	}
+}
+
+func TestArithmetic(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"BUILDKITE_PARALLEL_JOB": "3",
+		"EXPR":                   "2+3",
+		"EMPTY":                  "",
+	})
+
+	// Expected values are the output of bash 5.2
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`$((BUILDKITE_PARALLEL_JOB + 1))`, `4`},
+		{`$(($BUILDKITE_PARALLEL_JOB * 2))`, `6`},
+		{`$((1 + 2 * 3))`, `7`},
+		{`$(((1 + 2) * 3))`, `9`},
+		{`$((7 / 2))`, `3`},
+		{`$((-7 / 2))`, `-3`},
+		{`$((-7 % 3))`, `-1`},
+		{`$((2 ** 10))`, `1024`},
+		{`$((-2 ** 2))`, `4`},
+		{`$((2 ** 3 ** 2))`, `512`},
+		{`$((1 << 4))`, `16`},
+		{`$((-16 >> 2))`, `-4`},
+		{`$((5 & 3))`, `1`},
+		{`$((5 | 3))`, `7`},
+		{`$((5 ^ 3))`, `6`},
+		{`$((~5))`, `-6`},
+		{`$((!5))`, `0`},
+		{`$((!0))`, `1`},
+		{`$((3 < 4))`, `1`},
+		{`$((3 <= 3))`, `1`},
+		{`$((3 > 4))`, `0`},
+		{`$((4 >= 5))`, `0`},
+		{`$((3 == 3))`, `1`},
+		{`$((3 != 3))`, `0`},
+		{`$((1 && 0))`, `0`},
+		{`$((1 || 0))`, `1`},
+		{`$((0 && 1/0))`, `0`},
+		{`$((1 || 1/0))`, `1`},
+		{`$((BUILDKITE_PARALLEL_JOB > 2 ? 10 : 20))`, `10`},
+		{`$((0 ? 1/0 : 7))`, `7`},
+		{`$((1 ? 2 : 3 ? 4 : 5))`, `2`},
+		{`$((EXPR * 2))`, `10`},
+		{`$((UNSET + 1))`, `1`},
+		{`$((EMPTY + 1))`, `1`},
+		{`$((0x1f))`, `31`},
+		{`$((017))`, `15`},
+		{`$((2#101))`, `5`},
+		{`$((36#z))`, `35`},
+		{`$((64#_))`, `63`},
+		{`$((1, 2, 3))`, `3`},
+		{`$(())`, `0`},
+		{`$((  ))`, `0`},
+		{`$((${UNSET:-4} + ${#EXPR}))`, `7`},
+		{`$(((((1)))))`, `1`},
+		{`$((1 - -1))`, `2`},
+		{`$((--1))`, `1`},
+		{`job-$((BUILDKITE_PARALLEL_JOB + 1))-of-$((${TOTAL:-4}))`, `job-4-of-4`},
+		{`${UNSET:-$((1 + 1))}`, `2`},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", tc.Str, err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"SELF": "SELF",
+	})
+
+	for _, tc := range []struct {
+		Str         string
+		ExpectedErr string
+	}{
+		{`$((1 / 0))`, `$((1 / 0)): division by 0`},
+		{`$((2 ** -1))`, `$((2 ** -1)): exponent less than 0`},
+		{`$((1 + ))`, `$((1 + )): syntax error: operand expected`},
+		{`$((1 ? 2))`, `$((1 ? 2)): syntax error: expected ` + "`:'" + ` for conditional expression`},
+		{`$((1 2))`, `$((1 2)): syntax error: unexpected token (error token is "2")`},
+		{`$((09))`, `$((09)): value too great for base (error token is "09")`},
+		{`$((SELF))`, `$((SELF)): SELF: expression recursion level exceeded`},
+	} {
+		_, err := interpolate.Interpolate(environ, tc.Str)
+		if err == nil || err.Error() != tc.ExpectedErr {
+			t.Fatalf("Test %q should have failed with error %q, got %v", tc.Str, tc.ExpectedErr, err)
+		}
+	}
+}
+
+func TestUnclosedArithmetic(t *testing.T) {
+	t.Parallel()
+
+	unclosed := strings.Repeat("$((", 40)
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{unclosed, unclosed},
+		{unclosed + "$((1 + 2))", unclosed + "3"},
+		{strings.Repeat("$((1)x ", 40), strings.Repeat("$((1)x ", 40)},
+	} {
+		result, err := interpolate.Interpolate(nil, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+
+	// an unterminated brace expansion within them is still a parse error
+	_, err := interpolate.Interpolate(nil, strings.Repeat("$(( ${A:-(", 40))
+	var parseErr *interpolate.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Kind != interpolate.ParseErrorUnterminated {
+		t.Fatalf("Expected an unterminated *ParseError, got %v", err)
+	}
+}
+
+func TestArithmeticCanBeDisabled(t *testing.T) {
+	t.Parallel()
+
+	for _, str := range []string{
+		`$((1 + 2))`,
+		`echo $(( $(date +%s) - 60 ))`,
+	} {
+		result, err := interpolate.InterpolateWithOptions(nil, str, interpolate.Options{NoArithmetic: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != str {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", str, str, result)
+		}
+	}
+}
+
+// fakeCommandRunner returns canned output for commands, and fails for any it doesn't know about
+type fakeCommandRunner map[string]string
+
+func (f fakeCommandRunner) RunCommand(command string, env interpolate.Env) (string, error) {
+	out, ok := f[command]
+	if !ok {
+		return "", fmt.Errorf("unknown command %q", command)
+	}
+	return out, nil
+}
+
+func TestCommandSubstitution(t *testing.T) {
+	t.Parallel()
+
+	runner := fakeCommandRunner{
+		"git rev-parse HEAD":      "cfeeee3fa7fa1a6311723f5cbff95b738ec6e683\n\n",
+		"echo $(basename $(pwd))": "interpolate\n",
+		`echo ")" '(' \)`:         ") ( )",
+		"date +%s":                "1700000000",
+		"echo `date +%s`":         "1700000000",
+		"":                        "",
+	}
+	opts := interpolate.Options{CommandRunner: runner}
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`commit $(git rev-parse HEAD)!`, `commit cfeeee3fa7fa1a6311723f5cbff95b738ec6e683!`},
+		{`dir $(echo $(basename $(pwd)))`, `dir interpolate`},
+		{`$(echo ")" '(' \))`, `) ( )`},
+		{"`date +%s`", `1700000000`},
+		{"$(echo `date +%s`)", `1700000000`},
+		{"`echo \\`date +%s\\``", `1700000000`},
+		{`$()`, ``},
+		{`${UNSET:-$(date +%s)}`, `1700000000`},
+		{`$(( $(date +%s) - 1700000000 ))`, `0`},
+		{"\\$(date +%s) \\`date +%s\\`", "$(date +%s) `date +%s`"},
+	} {
+		result, err := interpolate.InterpolateWithOptions(nil, tc.Str, opts)
+		if err != nil {
+			t.Fatalf("Test %q failed: %v", tc.Str, err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestCommandSubstitutionErrors(t *testing.T) {
+	t.Parallel()
+
+	opts := interpolate.Options{CommandRunner: fakeCommandRunner{}}
+
+	for _, tc := range []struct {
+		Str         string
+		ExpectedErr string
+	}{
+		{`$(rm -rf /)`, `$(rm -rf /): unknown command "rm -rf /"`},
+		{`$(echo hello`, `Expected command substitution to end with ) (line 1, column 13)`},
+		{`$(echo ")`, `Expected double quoted string in command substitution to end with " (line 1, column 10)`},
+		{`$(echo ')`, `Expected single quoted string in command substitution to end with ' (line 1, column 10)`},
+		{"`echo hello", "Expected command substitution to end with ` (line 1, column 12)"},
+	} {
+		_, err := interpolate.InterpolateWithOptions(nil, tc.Str, opts)
+		if err == nil || err.Error() != tc.ExpectedErr {
+			t.Fatalf("Test %q should have failed with error %q, got %v", tc.Str, tc.ExpectedErr, err)
+		}
+	}
+}
+
+func TestRespectingQuotes(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{"HOME": "/home/llama", "NAME": "Dolly"})
+	opts := interpolate.Options{RespectQuotes: true}
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`echo '$HOME is literal'`, `echo '$HOME is literal'`},
+		{`echo "$HOME is expanded"`, `echo "/home/llama is expanded"`},
+		{`echo $HOME '$HOME' "$HOME"`, `echo /home/llama '$HOME' "/home/llama"`},
+		{`echo "it's $NAME"`, `echo "it's Dolly"`},
+		{`echo "'$NAME'"`, `echo "'Dolly'"`},
+		{`echo '"$NAME"'`, `echo '"$NAME"'`},
+		{`echo "\"$NAME\""`, `echo "\"Dolly\""`},
+		{`echo \'$NAME\'`, `echo \'Dolly\'`},
+		{`echo $'it\'s $NAME\n'`, `echo $'it\'s $NAME\n'`},
+		{`echo "${NAME:-"a default"}"`, `echo "Dolly"`},
+		{`echo "${UNSET:-a default}"`, `echo "a default"`},
+		{`echo "$$NAME" '$$NAME'`, `echo "$NAME" '$$NAME'`},
+		{`echo "$" ''`, `echo "$" ''`},
+	} {
+		result, err := interpolate.InterpolateWithOptions(environ, tc.Str, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestRespectingQuotesErrors(t *testing.T) {
+	t.Parallel()
+
+	opts := interpolate.Options{RespectQuotes: true}
+
+	for _, tc := range []struct {
+		Str         string
+		ExpectedErr string
+	}{
+		{`echo 'hello`, `Expected single quoted string to end with ' (line 1, column 6)`},
+		{`echo $'hello\'`, `Expected single quoted string to end with ' (line 1, column 6)`},
+		{`echo "hello' 'world`, `Expected double quoted string to end with " (line 1, column 6)`},
+		{`echo "${HELLO:-}`, `Expected double quoted string to end with " (line 1, column 6)`},
+	} {
+		_, err := interpolate.InterpolateWithOptions(nil, tc.Str, opts)
+		if err == nil || err.Error() != tc.ExpectedErr {
+			t.Fatalf("Test %q should have failed with error %q, got %v", tc.Str, tc.ExpectedErr, err)
+		}
+	}
+}
+
+func TestCommandSubstitutionRequiresRunnerToExpand(t *testing.T) {
+	t.Parallel()
+
+	opts := interpolate.Options{CommandRunner: fakeCommandRunner{}}
+	expr, err := interpolate.NewParserWithOptions(`$(date +%s)`, opts).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantErr := `$(date +%s): command substitution requires a CommandRunner`
+	if _, err := expr.Expand(interpolate.NewMapEnv(nil)); err == nil || err.Error() != wantErr {
+		t.Fatalf("Expected error %q, got %v", wantErr, err)
+	}
+
+	runner := interpolate.CommandRunnerFunc(func(command string, env interpolate.Env) (string, error) {
+		val, _ := env.Get("VALUE")
+		return command + " " + val, nil
+	})
+	result, err := expr.ExpandWithOptions(interpolate.NewMapEnv(map[string]string{"VALUE": "llamas"}), interpolate.Options{CommandRunner: runner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "date +%s llamas"; result != want {
+		t.Fatalf("Expected %q, got %q", want, result)
+	}
+}
+
+// argsEnv is an Env with positional arguments
+type argsEnv struct {
+	interpolate.Env
+	args []string
+}
+
+func (e argsEnv) Args() []string {
+	return e.args
+}
+
+func TestPositionalParameters(t *testing.T) {
+	t.Parallel()
+
+	environ := argsEnv{
+		Env:  interpolate.NewMapEnv(map[string]string{"GREETING": "hello"}),
+		args: []string{"one", "two", "three", "4", "5", "6", "7", "8", "9", "ten"},
+	}
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`$1 $2 $3`, `one two three`},
+		{`$10`, `one0`},
+		{`${10}`, `ten`},
+		{`${1}`, `one`},
+		{`${11}`, ``},
+		{`$#`, `10`},
+		{`${#}`, `10`},
+		{`$@`, `one two three 4 5 6 7 8 9 ten`},
+		{`${*}`, `one two three 4 5 6 7 8 9 ten`},
+		{`${UNSET:-$2}`, `two`},
+		{`$0 $$1`, `$0 $1`},
+		{`${#GREETING}`, `5`},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestPositionalParametersWithoutArgs(t *testing.T) {
+	t.Parallel()
+
+	for _, str := range []string{
+		`That'll be $1.00`,
+		`$1 $2 $9 ${1} ${10}`,
+		`$# ${#} $@ ${@} $* ${*}`,
+		`email me at llama$@example.com`,
+	} {
+		result, err := interpolate.Interpolate(nil, str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != str {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", str, str, result)
+		}
+	}
+}
+
+type readOnlyEnv map[string]string
+
+func (e readOnlyEnv) Get(key string) (string, bool) {
+	val, ok := e[key]
+	return val, ok
+}
+
+func TestAssignDefaultValuesRequireMutableEnv(t *testing.T) {
+	t.Parallel()
+
+	environ := readOnlyEnv{"DAY": "Blarghday"}
+
+	result, err := interpolate.Interpolate(environ, `${DAY:=Wednesday}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result != "Blarghday" {
+		t.Fatalf("Expected %q, got %q", "Blarghday", result)
+	}
+
+	wantErr := `$TODAY: cannot assign in a read-only environment`
+	if _, err := interpolate.Interpolate(environ, `${TODAY:=Wednesday}`); err == nil || err.Error() != wantErr {
+		t.Fatalf("Expected error %q, got %v", wantErr, err)
+	}
+}
+
 func TestRequiredVariables(t *testing.T) {
 	t.Parallel()
 
+	environ := interpolate.NewMapEnv(map[string]string{
+		"EMPTY_VAR": "",
+	})
+
 	for _, tc := range []struct {
 		Str         string
 		ExpectedErr string
@@ -253,14 +1026,43 @@ func TestRequiredVariables(t *testing.T) {
 		{`Hello ${REQUIRED_VAR?}`, `$REQUIRED_VAR: not set`},
 		{`Hello ${REQUIRED_VAR?y u no set me? :-{}`, `$REQUIRED_VAR: y u no set me? :-{`},
 		{`Hello ${REQUIRED_VAR?{}}`, `$REQUIRED_VAR: {`},
+		{`Hello ${REQUIRED_VAR:?}`, `$REQUIRED_VAR: not set`},
+		{`Hello ${EMPTY_VAR:?}`, `$EMPTY_VAR: set but empty`},
+		{`Hello ${EMPTY_VAR:?y u no fill me?}`, `$EMPTY_VAR: y u no fill me?`},
 	} {
-		_, err := interpolate.Interpolate(nil, tc.Str)
+		_, err := interpolate.Interpolate(environ, tc.Str)
 		if err == nil || err.Error() != tc.ExpectedErr {
 			t.Fatalf("Test %q should have failed with error %q, got %v", tc.Str, tc.ExpectedErr, err)
 		}
 	}
 }
 
+func TestRequiredVariablesThatAreSet(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"SET_VAR":   "llamas",
+		"EMPTY_VAR": "",
+	})
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`Hello ${SET_VAR?}`, `Hello llamas`},
+		{`Hello ${SET_VAR:?}`, `Hello llamas`},
+		{`Hello ${EMPTY_VAR?}`, `Hello `},
+	} {
+		result, err := interpolate.Interpolate(environ, tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
 func TestEscapingVariables(t *testing.T) {
 	t.Parallel()
 
@@ -304,6 +1106,10 @@ func TestEscapingVariables(t *testing.T) {
 			input: `echo "my favourite mountain is cotopaxi" | grep 'xi$$'`,
 			want:  `echo "my favourite mountain is cotopaxi" | grep 'xi$'`,
 		},
+		{
+			input: `echo "costs \$5" | grep '${\}$$5'`,
+			want:  `echo "costs $5" | grep '\$5'`,
+		},
 	} {
 		result, err := interpolate.Interpolate(nil, tc.input)
 		if err != nil {
@@ -325,8 +1131,18 @@ func TestExtractingIdentifiers(t *testing.T) {
 		{`Hello ${REQUIRED_VAR?}`, []string{`REQUIRED_VAR`}},
 		{`${LLAMAS:-${ROCK:-true}}`, []string{`LLAMAS`, `ROCK`}},
 		{`${BUILDKITE_COMMIT:0}`, []string{`BUILDKITE_COMMIT`}},
+		{`${BUILDKITE_TAG:+--tag=$BUILDKITE_TAG}`, []string{`BUILDKITE_TAG`, `BUILDKITE_TAG`}},
+		{`${BUILDKITE_TAG+${PREFIX}-$SUFFIX}`, []string{`BUILDKITE_TAG`, `PREFIX`, `SUFFIX`}},
+		{`${BUILDKITE_TAG-$DEFAULT_TAG}`, []string{`BUILDKITE_TAG`}},
+		{`${BUILDKITE_TAG:?needs $HELP_URL}`, []string{`BUILDKITE_TAG`}},
+		{`${FILE%%$EXTENSION}`, []string{`FILE`, `EXTENSION`}},
+		{`${BRANCH//$FROM/$TO}`, []string{`BRANCH`, `FROM`, `TO`}},
+		{`${#BUILDKITE_COMMIT}`, []string{`BUILDKITE_COMMIT`}},
+		{`${!TARGET_ENV} ${!BUILDKITE_*}`, []string{`TARGET_ENV`}},
+		{`$((BUILDKITE_PARALLEL_JOB + ${OFFSET:-1} * 0x10))`, []string{`BUILDKITE_PARALLEL_JOB`, `OFFSET`}},
 		{`$BUILDKITE_COMMIT hello there $$DOUBLE_DOLLAR \$ESCAPED_DOLLAR`, []string{`BUILDKITE_COMMIT`, `$DOUBLE_DOLLAR`, `$ESCAPED_DOLLAR`}},
 		{`This $ is not a variable`, []string{}},
+		{`$1 ${10} $# $@ $*`, []string{}},
 	} {
 		id, err := interpolate.Identifiers(tc.Str)
 		if err != nil {
@@ -350,3 +1166,204 @@ func BenchmarkBasicInterpolate(b *testing.B) {
 		_, _ = interpolate.Interpolate(env, "Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}")
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Str     string
+		Kind    interpolate.ParseErrorKind
+		Offset  int
+		Line    int
+		Column  int
+		Snippet string
+	}{
+		{`${FOO`, interpolate.ParseErrorUnterminated, 5, 1, 6, `${FOO`},
+		{`${FOO:-bar`, interpolate.ParseErrorUnterminated, 10, 1, 11, `${FOO:-bar`},
+		{"steps:\n  - command: echo ${FOO~x}\n  - wait", interpolate.ParseErrorInvalidOperator, 30, 2, 24, `  - command: echo ${FOO~x}`},
+		{"🦀 ${FOO@Z}", interpolate.ParseErrorInvalidOperator, 11, 1, 9, `🦀 ${FOO@Z}`},
+		{`${-FOO}`, interpolate.ParseErrorInvalidIdentifier, 2, 1, 3, `${-FOO}`},
+		{`${FOO:x}`, interpolate.ParseErrorInvalidNumber, 6, 1, 7, `${FOO:x}`},
+		{`${FOO:1:y}`, interpolate.ParseErrorInvalidNumber, 8, 1, 9, `${FOO:1:y}`},
+		{`${`, interpolate.ParseErrorUnterminated, 2, 1, 3, `${`},
+		{`${@x}`, interpolate.ParseErrorInvalidOperator, 3, 1, 4, `${@x}`},
+		{`${@`, interpolate.ParseErrorUnterminated, 3, 1, 4, `${@`},
+	} {
+		_, err := interpolate.Interpolate(nil, tc.Str)
+
+		var parseErr *interpolate.ParseError
+		if !errors.As(err, &parseErr) {
+			t.Fatalf("Test %q should have failed with a *ParseError, got %v", tc.Str, err)
+		}
+		if parseErr.Kind != tc.Kind || parseErr.Offset != tc.Offset || parseErr.Line != tc.Line ||
+			parseErr.Column != tc.Column || parseErr.Snippet != tc.Snippet {
+			t.Fatalf("Test %q failed with unexpected error %#v", tc.Str, parseErr)
+		}
+	}
+}
+
+func TestParseErrorMessages(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Str     string
+		Message string
+	}{
+		{`${FOO`, `Expected brace expansion to end with }, got end of input (line 1, column 6)`},
+		{`${#FOO`, `Expected length expansion to end with }, got end of input (line 1, column 7)`},
+		{`${!FOO`, `Expected indirect expansion to end with }, got end of input (line 1, column 7)`},
+		{`${10`, `Expected positional parameter expansion to end with }, got end of input (line 1, column 5)`},
+		{`${`, `Expected identifier to start with a letter, got end of input (line 1, column 3)`},
+		{`${FOO@`, `Expected a transformation operator, got end of input (line 1, column 7)`},
+		{`${FOO~x}`, `Expected an operator, got ~ (line 1, column 6)`},
+		{`${@x}`, `Expected special parameter expansion to end with }, got x (line 1, column 4)`},
+	} {
+		_, err := interpolate.Interpolate(nil, tc.Str)
+		if err == nil || err.Error() != tc.Message {
+			t.Fatalf("Test %q failed: Expected error %q, got %v", tc.Str, tc.Message, err)
+		}
+	}
+}
+
+func TestNoUnset(t *testing.T) {
+	t.Parallel()
+
+	environ := argsEnv{
+		Env:  interpolate.NewMapEnv(map[string]string{"SET_VAR": "llamas", "EMPTY_VAR": ""}),
+		args: []string{"one"},
+	}
+	opts := interpolate.Options{NoUnset: true}
+
+	for _, tc := range []struct {
+		Str  string
+		Name string
+		Span interpolate.Span
+	}{
+		{`Hello $UNSET`, `UNSET`, interpolate.Span{Start: 6, End: 12}},
+		{`Hello ${UNSET}!`, `UNSET`, interpolate.Span{Start: 6, End: 14}},
+		{`${UNSET:1}`, `UNSET`, interpolate.Span{Start: 0, End: 10}},
+		{`${#UNSET}`, `UNSET`, interpolate.Span{Start: 0, End: 9}},
+		{`${UNSET#a}`, `UNSET`, interpolate.Span{Start: 0, End: 10}},
+		{`${UNSET/a/b}`, `UNSET`, interpolate.Span{Start: 0, End: 12}},
+		{`${UNSET^}`, `UNSET`, interpolate.Span{Start: 0, End: 9}},
+		{`${UNSET@Q}`, `UNSET`, interpolate.Span{Start: 0, End: 10}},
+		{`$((UNSET + 1))`, `UNSET`, interpolate.Span{Start: 0, End: 14}},
+		{`$1 $2`, `2`, interpolate.Span{Start: 3, End: 5}},
+		{`${EMPTY_VAR:-$UNSET}`, `UNSET`, interpolate.Span{Start: 13, End: 19}},
+		{`${EMPTY_VAR:+x} ${SET_VAR:+${UNSET}}`, `UNSET`, interpolate.Span{Start: 27, End: 35}},
+	} {
+		_, err := interpolate.InterpolateWithOptions(environ, tc.Str, opts)
+
+		var unsetErr *interpolate.UnsetVariableError
+		if !errors.As(err, &unsetErr) {
+			t.Fatalf("Test %q should have failed with an *UnsetVariableError, got %v", tc.Str, err)
+		}
+		if unsetErr.Name != tc.Name || unsetErr.Span != tc.Span {
+			t.Fatalf("Test %q failed with unexpected error %#v", tc.Str, unsetErr)
+		}
+	}
+}
+
+func TestNoUnsetAllowsDefaults(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{"SET_VAR": "llamas"})
+	opts := interpolate.Options{NoUnset: true}
+
+	for _, tc := range []struct {
+		Str      string
+		Expected string
+	}{
+		{`Hello $SET_VAR`, `Hello llamas`},
+		{`${UNSET:-default}`, `default`},
+		{`${UNSET-default}`, `default`},
+		{`${UNSET:+alternate}`, ``},
+		{`${SET_VAR+alternate}`, `alternate`},
+		{`${UNSET:-${SET_VAR}}`, `llamas`},
+		{`${UNSET:+$ALSO_UNSET}`, ``},
+		{`$$UNSET $1 $#`, `$UNSET $1 $#`},
+	} {
+		result, err := interpolate.InterpolateWithOptions(environ, tc.Str, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Expected {
+			t.Fatalf("Test %q failed: Expected substring %q, got %q", tc.Str, tc.Expected, result)
+		}
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{"NAME": "Dolly", "EMPTY_VAR": ""})
+	opts := interpolate.Options{ContinueOnError: true}
+
+	result, err := interpolate.InterpolateWithOptions(environ,
+		`Hello ${NAME}, ${GREETING?} ${EMPTY_VAR:?needs a value} ${UNSET:-${ALSO_UNSET?}} $((1/0))!`, opts)
+	if expected := "Hello Dolly,    !"; result != expected {
+		t.Fatalf("Expected partial result %q, got %q", expected, result)
+	}
+
+	var expansionErrs *interpolate.ExpansionErrors
+	if !errors.As(err, &expansionErrs) {
+		t.Fatalf("Expected an *ExpansionErrors, got %v", err)
+	}
+
+	expected := []struct {
+		Message string
+		Span    interpolate.Span
+	}{
+		{`$GREETING: not set`, interpolate.Span{Start: 15, End: 27}},
+		{`$EMPTY_VAR: needs a value`, interpolate.Span{Start: 28, End: 55}},
+		{`$ALSO_UNSET: not set`, interpolate.Span{Start: 65, End: 79}},
+		{`$((1/0)): division by 0`, interpolate.Span{Start: 81, End: 89}},
+	}
+	if len(expansionErrs.Errors) != len(expected) {
+		t.Fatalf("Expected %d errors, got %v", len(expected), err)
+	}
+	for i, exp := range expected {
+		if got := expansionErrs.Errors[i]; got.Err.Error() != exp.Message || got.Span != exp.Span {
+			t.Fatalf("Expected error %d to be %q at %v, got %q at %v", i, exp.Message, exp.Span, got.Err, got.Span)
+		}
+	}
+
+	// the aggregated error works like one from errors.Join
+	var joined interface{ Unwrap() []error }
+	if !errors.As(err, &joined) || len(joined.Unwrap()) != len(expected) {
+		t.Fatalf("Expected an error compatible with errors.Join, got %#v", err)
+	}
+	if !strings.HasPrefix(err.Error(), "$GREETING: not set (at offset 15)\n$EMPTY_VAR: needs a value (at offset 28)\n") {
+		t.Fatalf("Unexpected error message %q", err.Error())
+	}
+}
+
+func TestContinueOnErrorWithNoUnset(t *testing.T) {
+	t.Parallel()
+
+	opts := interpolate.Options{ContinueOnError: true, NoUnset: true}
+
+	result, err := interpolate.InterpolateWithOptions(nil, "$A and ${B}\n$C", opts)
+	if result != " and \n" {
+		t.Fatalf("Expected partial result %q, got %q", " and \n", result)
+	}
+
+	var names []string
+	var expansionErrs *interpolate.ExpansionErrors
+	if errors.As(err, &expansionErrs) {
+		for _, e := range expansionErrs.Errors {
+			var unsetErr *interpolate.UnsetVariableError
+			if errors.As(e, &unsetErr) {
+				names = append(names, unsetErr.Name)
+			}
+		}
+	}
+	if expected := []string{"A", "B", "C"}; !reflect.DeepEqual(names, expected) {
+		t.Fatalf("Expected unset variables %v, got %v", expected, names)
+	}
+
+	result, err = interpolate.InterpolateWithOptions(nil, "no problems here", opts)
+	if err != nil || result != "no problems here" {
+		t.Fatalf("Expected no error, got %q, %v", result, err)
+	}
+}
@@ -1,7 +1,6 @@
 package interpolate
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 	"unicode"
@@ -27,16 +26,43 @@ EscapedBackslash   = "\\"
 Identifier         = letter { letters | digit | "_" }
 EscapedDollar      = ( "\$" | "$$" )
 EscapedExpansion   = EscapedDollar ( Identifier | Brace )
-UnescapedExpansion = "$" ( Identifier | Brace )
+UnescapedExpansion = "$" ( Identifier | Brace | Arithmetic | Positional | Special )
+Positional         = "1" ... "9"
+Special            = "#" | "@" | "*"
+Arithmetic         = "$((" { Expression | "(" | ")" } "))"
+Command            = "$(" command ")" | "`" command "`"
 Expansion          = UnescapedExpansion | EscapedExpansion
-Brace              = "{" Identifier [ Identifier BraceOperation ] "}"
+Brace              = "{" ( "\" | Length | Indirect | digit { digit } | Special | Identifier [ Identifier BraceOperation ] ) "}"
+Length             = "#" Identifier
+Indirect           = "!" Identifier [ "*" | "@" ]
 Text               = { EscapedBackslash | EscapedDollar | all characters except "$" }
 Expression         = { Text | Expansion }
+Quoted             = "'" { all characters except "'" } "'" | "$'" { "\" character | all characters except "'" } "'" |
+                     '"' { Text | Expansion } '"'
 EmptyValue         = ":-" { Expression }
 UnsetValue         = "-" { Expression }
 Substring          = ":" number [ ":" number ]
 Required           = "?" { Expression }
-Operation          = EmptyValue | UnsetValue | Substring | Required
+RequiredNonEmpty   = ":?" { Expression }
+AssignEmptyValue   = ":=" { Expression }
+AssignUnsetValue   = "=" { Expression }
+AlternateValue     = ":+" { Expression }
+AlternateSetValue  = "+" { Expression }
+RemovePrefix       = "#" { Expression }
+RemoveLongestPrefix = "##" { Expression }
+RemoveSuffix       = "%" { Expression }
+RemoveLongestSuffix = "%%" { Expression }
+Replace            = "/" [ "/" | "#" | "%" ] Pattern [ "/" { Expression } ]
+Pattern            = { Text | Expansion | "\/" }
+UppercaseFirst     = "^" { Expression }
+UppercaseAll       = "^^" { Expression }
+LowercaseFirst     = "," { Expression }
+LowercaseAll       = ",," { Expression }
+Transform          = "@" ( "Q" | "E" | "U" | "u" | "L" | "A" )
+Operation          = EmptyValue | UnsetValue | Substring | Required | RequiredNonEmpty | AssignEmptyValue | AssignUnsetValue |
+                     AlternateValue | AlternateSetValue | RemovePrefix | RemoveLongestPrefix | RemoveSuffix |
+                     RemoveLongestSuffix | Replace | UppercaseFirst | UppercaseAll | LowercaseFirst | LowercaseAll |
+                     Transform
 */
 
 const (
@@ -45,8 +71,22 @@ const (
 
 // Parser takes a string and parses out a tree of structs that represent text and Expansions
 type Parser struct {
-	input string // the string we are scanning
-	pos   int    // the current position
+	input  string  // the string we are scanning
+	pos    int     // the current position
+	opts   Options // options that change what we parse
+	sawEnd bool    // whether we've looked past the end of the input, which matters when streaming
+
+	// notArithmetic records where $(( turned out not to be an arithmetic expansion, and whether that
+	// was because it looked past the end of the input, so it isn't parsed all over again
+	notArithmetic map[int]bool
+
+	// unclosedArithmetic is set when an attempt at an arithmetic expansion ran out of input or hit an
+	// error, in which case any attempt it's nested within would too
+	unclosedArithmetic bool
+
+	// steps counts how many times a rune of the input has been looked at, which tests use to check
+	// that parsing doesn't go back over the input too many times
+	steps int
 }
 
 // NewParser returns a new instance of a Parser
@@ -57,6 +97,15 @@ func NewParser(str string) *Parser {
 	}
 }
 
+// NewParserWithOptions returns a new instance of a Parser that parses according to opts
+func NewParserWithOptions(str string, opts Options) *Parser {
+	return &Parser{
+		input: str,
+		pos:   0,
+		opts:  opts,
+	}
+}
+
 // Parse expansions out of the internal text and return them as a tree of Expressions
 func (p *Parser) Parse() (Expression, error) {
 	return p.parseExpression()
@@ -72,55 +121,172 @@ func (p *Parser) parseExpression(stop ...rune) (Expression, error) {
 			break
 		}
 
-		// check for our escaped characters first, as we assume nothing subsequently is escaped
-		if strings.HasPrefix(p.input[p.pos:], `\\`) {
-			p.pos += 2
-			expr = append(expr, ExpressionItem{Text: `\\`})
-			continue
+		var err error
+		if expr, err = p.parseItem(expr, stopStr); err != nil {
+			return nil, err
 		}
+	}
 
-		if strings.HasPrefix(p.input[p.pos:], `\$`) || strings.HasPrefix(p.input[p.pos:], `$$`) {
-			p.pos += 2
+	return expr, nil
+}
+
+// parseItem parses the next item of an expression that ends at one of the stop runes, appending it
+// to expr. Double quoted strings are appended as several items.
+func (p *Parser) parseItem(expr Expression, stop string) (Expression, error) {
+	c := p.peekRune()
+	start := p.pos
 
-			ee, err := p.parseEscapedExpansion()
+	// when respecting quotes, single quoted strings are left alone and double quoted ones are expanded
+	if p.opts.RespectQuotes && stop == "" {
+		if c == '\'' || p.hasPrefix(`$'`) {
+			text, err := p.parseSingleQuoted()
 			if err != nil {
 				return nil, err
 			}
+			expr = append(expr, ExpressionItem{Text: text, Span: p.spanFrom(start)})
+			return expr, nil
+		} else if c == '"' {
+			quoted, err := p.parseDoubleQuoted()
+			if err != nil {
+				return nil, err
+			}
+			expr = append(expr, quoted...)
+			return expr, nil
+		}
+	}
 
-			expr = append(expr, ExpressionItem{Expansion: ee})
-			continue
+	// check for our escaped characters first, as we assume nothing subsequently is escaped
+	if p.hasPrefix(`\\`) {
+		p.pos += 2
+		expr = append(expr, ExpressionItem{Text: `\\`, Span: p.spanFrom(start)})
+		return expr, nil
+	}
+
+	// with command substitution, backquotes need escaping too
+	if p.hasPrefix("\\`") && p.opts.CommandRunner != nil {
+		p.pos += 2
+		expr = append(expr, ExpressionItem{Expansion: EscapedBackquoteExpansion{}, Span: p.spanFrom(start)})
+		return expr, nil
+	}
+
+	// escaped quotes don't start or end a quoted string, and are left for the shell to unescape
+	if (p.hasPrefix(`\'`) || p.hasPrefix(`\"`)) && p.opts.RespectQuotes {
+		p.pos += 2
+		expr = append(expr, ExpressionItem{Text: p.input[start:p.pos], Span: p.spanFrom(start)})
+		return expr, nil
+	}
+
+	if p.hasPrefix(`\$`) || p.hasPrefix(`$$`) {
+		p.pos += 2
+
+		ee, err := p.parseEscapedExpansion()
+		if err != nil {
+			return nil, err
 		}
 
-		// Ignore bash shell expansions
-		if strings.HasPrefix(p.input[p.pos:], `$(`) {
-			p.pos += 2
-			expr = append(expr, ExpressionItem{Text: `$(`})
-			continue
+		expr = append(expr, ExpressionItem{Expansion: ee, Span: p.spanFrom(start)})
+		return expr, nil
+	}
+
+	if p.hasPrefix(`$((`) && !p.opts.NoArithmetic {
+		if ae, ok := p.parseArithmeticExpansion(); ok {
+			expr = append(expr, ExpressionItem{Expansion: ae, Span: p.spanFrom(start)})
+			return expr, nil
 		}
+	}
 
-		// If we run into a dollar sign and it's not the last char, it's an expansion
-		if c == '$' && p.pos < (len(p.input)-1) {
-			expressionItem, err := p.parseExpansion()
-			if err != nil {
-				return nil, err
-			}
+	// Command substitution is only done if we've been given something to run the commands
+	if (p.hasPrefix(`$(`) || c == '`') && p.opts.CommandRunner != nil {
+		ce, err := p.parseCommandExpansion()
+		if err != nil {
+			return nil, err
+		}
 
-			expr = append(expr, expressionItem)
-			continue
+		expr = append(expr, ExpressionItem{Expansion: ce, Span: p.spanFrom(start)})
+		return expr, nil
+	}
+
+	// Ignore bash shell expansions
+	if p.hasPrefix(`$(`) {
+		p.pos += 2
+		expr = append(expr, ExpressionItem{Text: `$(`, Span: p.spanFrom(start)})
+		return expr, nil
+	}
+
+	// If we run into a dollar sign and it's not the last char, it's an expansion
+	if c == '$' && p.pos == len(p.input)-1 {
+		p.sawEnd = true
+	}
+	if c == '$' && p.pos < (len(p.input)-1) {
+		expressionItem, err := p.parseExpansion()
+		if err != nil {
+			return nil, err
 		}
+		expressionItem.Span = p.spanFrom(start)
 
-		// nibble a character, otherwise if it's a \ or a $ we can loop
-		c = p.nextRune()
+		expr = append(expr, expressionItem)
+		return expr, nil
+	}
+
+	// nibble a character, otherwise if it's a \ or a $ we can loop
+	_ = p.nextRune()
 
-		// Scan as much as we can into text
-		text := p.scanUntil(func(r rune) bool {
-			return (r == '$' || r == '\\' || strings.ContainsRune(stopStr, r))
-		})
+	// Scan as much as we can into text. Text can be split anywhere, so it doesn't matter if it runs
+	// into the end of the input.
+	sawEnd := p.sawEnd
+	_ = p.scanUntil(func(r rune) bool {
+		return (r == '$' || r == '\\' || strings.ContainsRune(stop, r) ||
+			(r == '`' && p.opts.CommandRunner != nil) ||
+			((r == '\'' || r == '"') && p.opts.RespectQuotes && stop == ""))
+	})
+
+	p.sawEnd = sawEnd
+
+	return append(expr, ExpressionItem{Text: p.input[start:p.pos], Span: p.spanFrom(start)}), nil
+}
 
-		expr = append(expr, ExpressionItem{Text: string(c) + text})
+// parseSingleQuoted parses a '...' or $'...' string, returning it exactly as written. Nothing is
+// expanded within it, and in a $'...' string a backslash escapes the character after it.
+func (p *Parser) parseSingleQuoted() (string, error) {
+	start := p.pos
+	ansiC := p.nextRune() == '$'
+	if ansiC {
+		_ = p.nextRune()
 	}
 
-	return expr, nil
+	for {
+		switch c := p.nextRune(); c {
+		case eof:
+			return "", p.errorf(start, ParseErrorUnterminated, "Expected single quoted string to end with '")
+		case '\\':
+			if ansiC {
+				_ = p.nextRune()
+			}
+		case '\'':
+			return p.input[start:p.pos], nil
+		}
+	}
+}
+
+// parseDoubleQuoted parses a "..." string. Expansions within it are parsed as normal, but single
+// quotes have no special meaning.
+func (p *Parser) parseDoubleQuoted() (Expression, error) {
+	start := p.pos
+	_ = p.nextRune()
+	openQuote := ExpressionItem{Text: `"`, Span: p.spanFrom(start)}
+
+	expr, err := p.parseExpression('"')
+	if err != nil {
+		return nil, err
+	}
+
+	if c := p.peekRune(); c != '"' {
+		return nil, p.errorf(start, ParseErrorUnterminated, "Expected double quoted string to end with \"")
+	}
+	closeStart := p.pos
+	_ = p.nextRune()
+
+	return append(append(Expression{openQuote}, expr...), ExpressionItem{Text: `"`, Span: p.spanFrom(closeStart)}), nil
 }
 
 // parseEscapedExpansion attempts to extract a *potential* identifier or brace
@@ -162,9 +328,10 @@ func (p *Parser) parseEscapedExpansion() (EscapedExpansion, error) {
 func (p *Parser) parseExpansion() (ExpressionItem, error) {
 	var empty ExpressionItem
 
-	if c := p.nextRune(); c != '$' {
-		return empty, fmt.Errorf("Expected expansion to start with $, got %c", c)
+	if c := p.peekRune(); c != '$' {
+		return empty, p.errorf(p.pos, ParseErrorUnexpected, "Expected expansion to start with $, got %s", describeRune(c))
 	}
+	_ = p.nextRune()
 
 	c := p.peekRune()
 
@@ -177,6 +344,15 @@ func (p *Parser) parseExpansion() (ExpressionItem, error) {
 		return ExpressionItem{Expansion: expansion}, nil
 	}
 
+	// positional and special parameters, which are left as text if there aren't any arguments
+	if '1' <= c && c <= '9' {
+		_ = p.nextRune()
+		return ExpressionItem{Expansion: PositionalExpansion{Index: int(c - '0')}}, nil
+	} else if c == '#' || c == '@' || c == '*' {
+		_ = p.nextRune()
+		return ExpressionItem{Expansion: SpecialExpansion{Name: c}}, nil
+	}
+
 	// if not a letter, it's a literal dollar sign
 	if !unicode.IsLetter(c) {
 		return ExpressionItem{Text: "$"}, nil
@@ -193,9 +369,180 @@ func (p *Parser) parseExpansion() (ExpressionItem, error) {
 	}}, nil
 }
 
+// parseArithmeticExpansion attempts to parse $((expression)). If it can't find the closing )) it
+// leaves the position alone and returns false, as it's probably $( (command) ) instead.
+func (p *Parser) parseArithmeticExpansion() (Expansion, bool) {
+	start := p.pos
+	if sawEnd, ok := p.notArithmetic[start]; ok {
+		p.sawEnd = p.sawEnd || sawEnd
+		return nil, false
+	}
+	p.pos += len(`$((`)
+	p.unclosedArithmetic = false
+
+	var content Expression
+	depth := 0
+	for {
+		expr, err := p.parseExpression('(', ')')
+		if err != nil || p.unclosedArithmetic || p.peekRune() == eof {
+			p.unclosedArithmetic = true
+			break
+		}
+		content = append(content, expr...)
+
+		if c, parenStart := p.peekRune(), p.pos; c == '(' {
+			_ = p.nextRune()
+			depth++
+			content = append(content, ExpressionItem{Text: "(", Span: p.spanFrom(parenStart)})
+			continue
+		} else if c == ')' && depth > 0 {
+			_ = p.nextRune()
+			depth--
+			content = append(content, ExpressionItem{Text: ")", Span: p.spanFrom(parenStart)})
+			continue
+		} else if p.hasPrefix(`))`) {
+			p.pos += len(`))`)
+			return ArithmeticExpansion{Content: content}, true
+		}
+		break
+	}
+
+	if p.notArithmetic == nil {
+		p.notArithmetic = map[int]bool{}
+	}
+	p.notArithmetic[start] = p.sawEnd
+	p.pos = start
+	return nil, false
+}
+
+// parseCommandExpansion parses $(command) or `command`. We don't parse the command, but we do need to
+// understand enough of the shell's quoting to find where it ends.
+func (p *Parser) parseCommandExpansion() (Expansion, error) {
+	start := p.pos
+	if c := p.nextRune(); c == '`' {
+		return p.parseBackquotedCommandExpansion()
+	} else if c != '$' || p.nextRune() != '(' {
+		return nil, p.errorf(start, ParseErrorUnexpected, "Expected command substitution to start with $( or `, got %s", describeRune(c))
+	}
+
+	start = p.pos
+	if err := p.skipCommand(); err != nil {
+		return nil, err
+	}
+
+	return CommandExpansion{Command: p.input[start : p.pos-1]}, nil
+}
+
+// skipCommand moves past the rest of a $(command), up to and including the closing parenthesis
+func (p *Parser) skipCommand() error {
+	depth := 0
+	for {
+		switch c := p.nextRune(); c {
+		case eof:
+			return p.errorf(p.pos, ParseErrorUnterminated, "Expected command substitution to end with )")
+		case '\\':
+			_ = p.nextRune()
+		case '\'':
+			if p.scanUntil(func(r rune) bool { return r == '\'' }); p.nextRune() != '\'' {
+				return p.errorf(p.pos, ParseErrorUnterminated, "Expected single quoted string in command substitution to end with '")
+			}
+		case '"':
+			if err := p.skipDoubleQuoted(); err != nil {
+				return err
+			}
+		case '`':
+			if _, err := p.parseBackquotedCommandExpansion(); err != nil {
+				return err
+			}
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return nil
+			}
+			depth--
+		}
+	}
+}
+
+// skipDoubleQuoted moves past the rest of a double quoted string within a command, which can contain
+// further command substitutions
+func (p *Parser) skipDoubleQuoted() error {
+	for {
+		switch c := p.nextRune(); c {
+		case eof:
+			return p.errorf(p.pos, ParseErrorUnterminated, "Expected double quoted string in command substitution to end with \"")
+		case '\\':
+			_ = p.nextRune()
+		case '"':
+			return nil
+		case '`':
+			if _, err := p.parseBackquotedCommandExpansion(); err != nil {
+				return err
+			}
+		case '$':
+			if p.peekRune() == '(' {
+				_ = p.nextRune()
+				if err := p.skipCommand(); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+// parseBackquotedCommandExpansion parses the rest of a `command`. Within backquotes, a backslash
+// escapes $, ` and \ and is removed, the same as in a shell.
+func (p *Parser) parseBackquotedCommandExpansion() (Expansion, error) {
+	var command strings.Builder
+	for {
+		start := p.pos
+		switch c := p.nextRune(); c {
+		case eof:
+			return nil, p.errorf(p.pos, ParseErrorUnterminated, "Expected command substitution to end with `")
+		case '`':
+			return CommandExpansion{Command: command.String(), Backquoted: true}, nil
+		case '\\':
+			if next := p.peekRune(); next == '$' || next == '`' || next == '\\' {
+				start = p.pos
+				_ = p.nextRune()
+			}
+		}
+		command.WriteString(p.input[start:p.pos])
+	}
+}
+
 func (p *Parser) parseBraceExpansion() (Expansion, error) {
-	if c := p.nextRune(); c != '{' {
-		return nil, fmt.Errorf("Expected brace expansion to start with {, got %c", c)
+	if c := p.peekRune(); c != '{' {
+		return nil, p.errorf(p.pos, ParseErrorUnexpected, "Expected brace expansion to start with {, got %s", describeRune(c))
+	}
+	_ = p.nextRune()
+
+	// ${\} is a backslash that doesn't escape a $ after it
+	if p.hasPrefix(`\}`) {
+		p.pos += 2
+		return EscapedBackslashExpansion{}, nil
+	}
+
+	if c := p.peekRune(); c == '#' || c == '@' || c == '*' {
+		_ = p.nextRune()
+		if p.peekRune() == '}' {
+			_ = p.nextRune()
+			return SpecialExpansion{Name: c, Braced: true}, nil
+		}
+		if c == '#' {
+			return p.parseLengthExpansion()
+		}
+		kind := ParseErrorInvalidOperator
+		if p.peekRune() == eof {
+			kind = ParseErrorUnterminated
+		}
+		return nil, p.errorf(p.pos, kind, "Expected special parameter expansion to end with }, got %s", describeRune(p.peekRune()))
+	} else if '0' <= c && c <= '9' {
+		return p.parsePositionalExpansion()
+	} else if c == '!' {
+		_ = p.nextRune()
+		return p.parseIndirectExpansion()
 	}
 
 	identifier, err := p.scanIdentifier()
@@ -213,18 +560,37 @@ func (p *Parser) parseBraceExpansion() (Expansion, error) {
 	var operator string
 	var exp Expansion
 
-	// Parse an operator, some trickery is needed to handle : vs :-
+	// Parse an operator, some trickery is needed to handle : vs :-, :=, :+ and :?
+	opStart := p.pos
 	if op1 := p.nextRune(); op1 == ':' {
-		if op2 := p.peekRune(); op2 == '-' {
+		if op2 := p.peekRune(); op2 == '-' || op2 == '=' || op2 == '+' || op2 == '?' {
 			_ = p.nextRune()
-			operator = ":-"
+			operator = ":" + string(op2)
 		} else {
 			operator = ":"
 		}
-	} else if op1 == '?' || op1 == '-' {
+	} else if op1 == '#' || op1 == '%' || op1 == '^' || op1 == ',' {
+		// # and % can be doubled to match the longest pattern, and ^ and , to convert every character
+		if op2 := p.peekRune(); op2 == op1 {
+			_ = p.nextRune()
+			operator = string(op1) + string(op2)
+		} else {
+			operator = string(op1)
+		}
+	} else if op1 == '/' {
+		// a second character picks between replacing the first match, all matches, or an anchored match
+		if op2 := p.peekRune(); op2 == '/' || op2 == '#' || op2 == '%' {
+			_ = p.nextRune()
+			operator = string(op1) + string(op2)
+		} else {
+			operator = string(op1)
+		}
+	} else if op1 == '?' || op1 == '-' || op1 == '=' || op1 == '+' || op1 == '@' {
 		operator = string(op1)
+	} else if op1 == eof {
+		return nil, p.errorf(opStart, ParseErrorUnterminated, "Expected brace expansion to end with }, got %s", describeRune(op1))
 	} else {
-		return nil, fmt.Errorf("Expected an operator, got %c", op1)
+		return nil, p.errorf(opStart, ParseErrorInvalidOperator, "Expected an operator, got %s", describeRune(op1))
 	}
 
 	switch operator {
@@ -243,16 +609,100 @@ func (p *Parser) parseBraceExpansion() (Expansion, error) {
 		if err != nil {
 			return nil, err
 		}
-	case `?`:
-		exp, err = p.parseRequiredExpansion(identifier)
+	case `?`, `:?`:
+		exp, err = p.parseRequiredExpansion(identifier, operator == `:?`)
+		if err != nil {
+			return nil, err
+		}
+	case `:=`, `=`:
+		exp, err = p.parseAssignDefaultExpansion(identifier, operator == `:=`)
+		if err != nil {
+			return nil, err
+		}
+	case `:+`, `+`:
+		exp, err = p.parseAlternateValueExpansion(identifier, operator == `:+`)
+		if err != nil {
+			return nil, err
+		}
+	case `#`, `##`, `%`, `%%`:
+		exp, err = p.parseRemovePatternExpansion(identifier, operator)
+		if err != nil {
+			return nil, err
+		}
+	case `/`, `//`, `/#`, `/%`:
+		exp, err = p.parseReplaceExpansion(identifier, operator)
+		if err != nil {
+			return nil, err
+		}
+	case `^`, `^^`, `,`, `,,`:
+		exp, err = p.parseCaseExpansion(identifier, operator)
+		if err != nil {
+			return nil, err
+		}
+	case `@`:
+		exp, err = p.parseTransformExpansion(identifier)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	if c := p.nextRune(); c != '}' {
-		return nil, fmt.Errorf("Expected brace expansion to end with }, got %c", c)
+	if c := p.peekRune(); c != '}' {
+		return nil, p.errorf(p.pos, ParseErrorUnterminated, "Expected brace expansion to end with }, got %s", describeRune(c))
 	}
+	_ = p.nextRune()
+
+	return exp, nil
+}
+
+func (p *Parser) parsePositionalExpansion() (Expansion, error) {
+	start := p.pos
+	digits := p.scanUntil(func(r rune) bool {
+		return r < '0' || r > '9'
+	})
+
+	index, err := strconv.Atoi(digits)
+	if err != nil || index < 1 {
+		return nil, p.errorf(start, ParseErrorInvalidNumber, "Expected a positional parameter from 1, got %s", digits)
+	}
+
+	if c := p.peekRune(); c != '}' {
+		return nil, p.errorf(p.pos, ParseErrorUnterminated, "Expected positional parameter expansion to end with }, got %s", describeRune(c))
+	}
+	_ = p.nextRune()
+
+	return PositionalExpansion{Index: index, Braced: true}, nil
+}
+
+func (p *Parser) parseLengthExpansion() (Expansion, error) {
+	identifier, err := p.scanIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	if c := p.peekRune(); c != '}' {
+		return nil, p.errorf(p.pos, ParseErrorUnterminated, "Expected length expansion to end with }, got %s", describeRune(c))
+	}
+	_ = p.nextRune()
+
+	return LengthExpansion{Identifier: identifier}, nil
+}
+
+func (p *Parser) parseIndirectExpansion() (Expansion, error) {
+	identifier, err := p.scanIdentifier()
+	if err != nil {
+		return nil, err
+	}
+
+	var exp Expansion = IndirectExpansion{Identifier: identifier}
+	if c := p.peekRune(); c == '*' || c == '@' {
+		_ = p.nextRune()
+		exp = PrefixNamesExpansion{Prefix: identifier, At: c == '@'}
+	}
+
+	if c := p.peekRune(); c != '}' {
+		return nil, p.errorf(p.pos, ParseErrorUnterminated, "Expected indirect expansion to end with }, got %s", describeRune(c))
+	}
+	_ = p.nextRune()
 
 	return exp, nil
 }
@@ -277,13 +727,14 @@ func (p *Parser) parseUnsetValueExpansion(identifier string) (Expansion, error)
 }
 
 func (p *Parser) parseSubstringExpansion(identifier string) (Expansion, error) {
+	start := p.pos
 	offset := p.scanUntil(func(r rune) bool {
 		return r == ':' || r == '}'
 	})
 
 	offsetInt, err := strconv.Atoi(strings.TrimSpace(offset))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse offset: %v", err)
+		return nil, p.errorf(start, ParseErrorInvalidNumber, "Unable to parse offset: %v", err)
 	}
 
 	if c := p.peekRune(); c == '}' {
@@ -291,32 +742,148 @@ func (p *Parser) parseSubstringExpansion(identifier string) (Expansion, error) {
 	}
 
 	_ = p.nextRune()
+	start = p.pos
 	length := p.scanUntil(func(r rune) bool {
 		return r == '}'
 	})
 
 	lengthInt, err := strconv.Atoi(strings.TrimSpace(length))
 	if err != nil {
-		return nil, fmt.Errorf("Unable to parse length: %v", err)
+		return nil, p.errorf(start, ParseErrorInvalidNumber, "Unable to parse length: %v", err)
 	}
 
 	return SubstringExpansion{Identifier: identifier, Offset: offsetInt, Length: lengthInt, HasLength: true}, nil
 }
 
-func (p *Parser) parseRequiredExpansion(identifier string) (Expansion, error) {
+func (p *Parser) parseRequiredExpansion(identifier string, checkEmpty bool) (Expansion, error) {
+	expr, err := p.parseExpression('}')
+	if err != nil {
+		return nil, err
+	}
+
+	return RequiredExpansion{Identifier: identifier, Message: expr, CheckEmpty: checkEmpty}, nil
+}
+
+func (p *Parser) parseAssignDefaultExpansion(identifier string, checkEmpty bool) (Expansion, error) {
+	expr, err := p.parseExpression('}')
+	if err != nil {
+		return nil, err
+	}
+
+	return AssignDefaultExpansion{Identifier: identifier, Content: expr, CheckEmpty: checkEmpty}, nil
+}
+
+func (p *Parser) parseAlternateValueExpansion(identifier string, checkEmpty bool) (Expansion, error) {
 	expr, err := p.parseExpression('}')
 	if err != nil {
 		return nil, err
 	}
 
-	return RequiredExpansion{Identifier: identifier, Message: expr}, nil
+	return AlternateValueExpansion{Identifier: identifier, Content: expr, CheckEmpty: checkEmpty}, nil
+}
+
+func (p *Parser) parseRemovePatternExpansion(identifier string, operator string) (Expansion, error) {
+	expr, err := p.parseExpression('}')
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case `#`:
+		return RemovePrefixExpansion{Identifier: identifier, Pattern: expr}, nil
+	case `##`:
+		return RemoveLongestPrefixExpansion{Identifier: identifier, Pattern: expr}, nil
+	case `%`:
+		return RemoveSuffixExpansion{Identifier: identifier, Pattern: expr}, nil
+	default:
+		return RemoveLongestSuffixExpansion{Identifier: identifier, Pattern: expr}, nil
+	}
+}
+
+func (p *Parser) parseReplaceExpansion(identifier string, operator string) (Expansion, error) {
+	var pattern Expression
+	for {
+		expr, err := p.parseExpression('/', '}')
+		if err != nil {
+			return nil, err
+		}
+		pattern = append(pattern, expr...)
+
+		// A lone backslash right before the / escapes it, leaving it in the pattern
+		if last := len(pattern) - 1; p.peekRune() == '/' && last >= 0 && pattern[last].Text == `\` {
+			_ = p.nextRune()
+			pattern[last].Text = `\/`
+			pattern[last].Span.End = p.pos
+			continue
+		}
+		break
+	}
+
+	// The replacement is optional, and without it matches are removed
+	var replacement Expression
+	if c := p.peekRune(); c == '/' {
+		_ = p.nextRune()
+		expr, err := p.parseExpression('}')
+		if err != nil {
+			return nil, err
+		}
+		replacement = expr
+	}
+
+	// A / can be escaped in the replacement too, but there the backslash is left out
+	for i, item := range replacement {
+		if item.Expansion == nil && strings.HasPrefix(item.Text, `\/`) {
+			replacement[i].Text = item.Text[1:]
+		}
+	}
+
+	switch operator {
+	case `/`:
+		return ReplaceExpansion{Identifier: identifier, Pattern: pattern, Replacement: replacement}, nil
+	case `//`:
+		return ReplaceAllExpansion{Identifier: identifier, Pattern: pattern, Replacement: replacement}, nil
+	case `/#`:
+		return ReplacePrefixExpansion{Identifier: identifier, Pattern: pattern, Replacement: replacement}, nil
+	default:
+		return ReplaceSuffixExpansion{Identifier: identifier, Pattern: pattern, Replacement: replacement}, nil
+	}
+}
+
+func (p *Parser) parseCaseExpansion(identifier string, operator string) (Expansion, error) {
+	expr, err := p.parseExpression('}')
+	if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case `^`:
+		return UppercaseFirstExpansion{Identifier: identifier, Pattern: expr}, nil
+	case `^^`:
+		return UppercaseAllExpansion{Identifier: identifier, Pattern: expr}, nil
+	case `,`:
+		return LowercaseFirstExpansion{Identifier: identifier, Pattern: expr}, nil
+	default:
+		return LowercaseAllExpansion{Identifier: identifier, Pattern: expr}, nil
+	}
+}
+
+func (p *Parser) parseTransformExpansion(identifier string) (Expansion, error) {
+	switch op := TransformOperator(p.peekRune()); op {
+	case TransformQuote, TransformEscape, TransformUppercase, TransformUppercaseFirst, TransformLowercase, TransformAssignment:
+		_ = p.nextRune()
+		return TransformExpansion{Identifier: identifier, Operator: op}, nil
+	case eof:
+		return nil, p.errorf(p.pos, ParseErrorUnterminated, "Expected a transformation operator, got %s", describeRune(eof))
+	default:
+		return nil, p.errorf(p.pos, ParseErrorInvalidOperator, "Expected a transformation operator, got %s", describeRune(rune(op)))
+	}
 }
 
 func (p *Parser) scanUntil(f func(rune) bool) string {
 	start := p.pos
-	for int(p.pos) < len(p.input) {
-		c, size := utf8.DecodeRuneInString(p.input[p.pos:])
-		if c == utf8.RuneError || f(c) {
+	for {
+		c, size := p.decodeRune()
+		if c == eof || c == utf8.RuneError || f(c) {
 			break
 		}
 		p.pos += size
@@ -325,28 +892,78 @@ func (p *Parser) scanUntil(f func(rune) bool) string {
 }
 
 func (p *Parser) scanIdentifier() (string, error) {
-	if c := p.peekRune(); !unicode.IsLetter(c) {
-		return "", fmt.Errorf("Expected identifier to start with a letter, got %c", c)
+	if c := p.peekRune(); c == eof {
+		return "", p.errorf(p.pos, ParseErrorUnterminated, "Expected identifier to start with a letter, got %s", describeRune(c))
+	} else if !unicode.IsLetter(c) {
+		return "", p.errorf(p.pos, ParseErrorInvalidIdentifier, "Expected identifier to start with a letter, got %s", describeRune(c))
 	}
 	notIdentifierChar := func(r rune) bool {
-		return !(unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_')
+		return !isIdentifierRune(r)
 	}
 	return p.scanUntil(notIdentifierChar), nil
 }
 
-func (p *Parser) nextRune() rune {
-	if int(p.pos) >= len(p.input) {
-		return eof
+// isIdentifierRune returns whether r can be part of an identifier after its first letter
+func isIdentifierRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r) || r == '_'
+}
+
+// isIdentifier returns whether str would be scanned as a whole identifier
+func isIdentifier(str string) bool {
+	p := NewParser(str)
+	id, err := p.scanIdentifier()
+	return err == nil && id == str
+}
+
+// spanFrom returns the span of input from start up to the current position
+func (p *Parser) spanFrom(start int) Span {
+	return Span{Start: start, End: p.pos}
+}
+
+// errorf returns a *ParseError for the problem at offset in the input
+func (p *Parser) errorf(offset int, kind ParseErrorKind, format string, args ...any) error {
+	return newParseError(p.input, offset, kind, format, args...)
+}
+
+// describeRune describes c for an error message, as eof can't be printed as a character
+func describeRune(c rune) string {
+	if c == eof {
+		return "end of input"
 	}
-	c, size := utf8.DecodeRuneInString(p.input[p.pos:])
+	return string(c)
+}
+
+func (p *Parser) nextRune() rune {
+	c, size := p.decodeRune()
 	p.pos += size
 	return c
 }
 
 func (p *Parser) peekRune() rune {
-	if int(p.pos) >= len(p.input) {
-		return eof
-	}
-	c, _ := utf8.DecodeRuneInString(p.input[p.pos:])
+	c, _ := p.decodeRune()
 	return c
 }
+
+// decodeRune returns the rune at the current position and its size, noting if we've looked past the
+// end of the input, including for a rune that's cut short by it
+func (p *Parser) decodeRune() (rune, int) {
+	p.steps++
+	if p.pos >= len(p.input) {
+		p.sawEnd = true
+		return eof, 0
+	}
+	if !utf8.FullRuneInString(p.input[p.pos:]) {
+		p.sawEnd = true
+	}
+	return utf8.DecodeRuneInString(p.input[p.pos:])
+}
+
+// hasPrefix returns whether the input at the current position starts with prefix, noting if we've
+// looked past the end of the input to find out
+func (p *Parser) hasPrefix(prefix string) bool {
+	if rest := p.input[p.pos:]; len(rest) < len(prefix) && strings.HasPrefix(prefix, rest) {
+		p.sawEnd = true
+		return false
+	}
+	return strings.HasPrefix(p.input[p.pos:], prefix)
+}
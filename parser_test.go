@@ -1,11 +1,16 @@
 package interpolate
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
 )
 
+// ignoreSpans compares expressions without where they were parsed from, which TestParserSpans covers
+var ignoreSpans = cmpopts.IgnoreFields(ExpressionItem{}, "Span")
+
 func TestParser(t *testing.T) {
 	t.Parallel()
 
@@ -153,6 +158,235 @@ func TestParser(t *testing.T) {
 				}},
 			},
 		},
+		{
+			input: `${HELLO_WORLD:=blah}`,
+			want: Expression{
+				{Expansion: AssignDefaultExpansion{
+					Identifier: "HELLO_WORLD",
+					Content: Expression{
+						{Text: "blah"},
+					},
+					CheckEmpty: true,
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD=$BLAH}`,
+			want: Expression{
+				{Expansion: AssignDefaultExpansion{
+					Identifier: "HELLO_WORLD",
+					Content: Expression{
+						{Expansion: VariableExpansion{Identifier: "BLAH"}},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD:+--hello=$HELLO_WORLD}`,
+			want: Expression{
+				{Expansion: AlternateValueExpansion{
+					Identifier: "HELLO_WORLD",
+					Content: Expression{
+						{Text: "--hello="},
+						{Expansion: VariableExpansion{Identifier: "HELLO_WORLD"}},
+					},
+					CheckEmpty: true,
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD+blah}`,
+			want: Expression{
+				{Expansion: AlternateValueExpansion{
+					Identifier: "HELLO_WORLD",
+					Content: Expression{
+						{Text: "blah"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD:?Required}`,
+			want: Expression{
+				{Expansion: RequiredExpansion{
+					Identifier: "HELLO_WORLD",
+					Message: Expression{
+						{Text: "Required"},
+					},
+					CheckEmpty: true,
+				}},
+			},
+		},
+		{
+			input: `${BUILDKITE_BRANCH#refs/heads/}`,
+			want: Expression{
+				{Expansion: RemovePrefixExpansion{
+					Identifier: "BUILDKITE_BRANCH",
+					Pattern: Expression{
+						{Text: "refs/heads/"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${BUILDKITE_BRANCH##*/}`,
+			want: Expression{
+				{Expansion: RemoveLongestPrefixExpansion{
+					Identifier: "BUILDKITE_BRANCH",
+					Pattern: Expression{
+						{Text: "*/"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${FILE%$EXTENSION}`,
+			want: Expression{
+				{Expansion: RemoveSuffixExpansion{
+					Identifier: "FILE",
+					Pattern: Expression{
+						{Expansion: VariableExpansion{Identifier: "EXTENSION"}},
+					},
+				}},
+			},
+		},
+		{
+			input: `${FILE%%.*}`,
+			want: Expression{
+				{Expansion: RemoveLongestSuffixExpansion{
+					Identifier: "FILE",
+					Pattern: Expression{
+						{Text: ".*"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${BUILDKITE_BRANCH//\//-}`,
+			want: Expression{
+				{Expansion: ReplaceAllExpansion{
+					Identifier: "BUILDKITE_BRANCH",
+					Pattern: Expression{
+						{Text: `\/`},
+					},
+					Replacement: Expression{
+						{Text: "-"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD/o}`,
+			want: Expression{
+				{Expansion: ReplaceExpansion{
+					Identifier: "HELLO_WORLD",
+					Pattern: Expression{
+						{Text: "o"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD/#$PREFIX/a/b}`,
+			want: Expression{
+				{Expansion: ReplacePrefixExpansion{
+					Identifier: "HELLO_WORLD",
+					Pattern: Expression{
+						{Expansion: VariableExpansion{Identifier: "PREFIX"}},
+					},
+					Replacement: Expression{
+						{Text: "a/b"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD/%d/}`,
+			want: Expression{
+				{Expansion: ReplaceSuffixExpansion{
+					Identifier: "HELLO_WORLD",
+					Pattern: Expression{
+						{Text: "d"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${#HELLO_WORLD}`,
+			want: Expression{
+				{Expansion: LengthExpansion{
+					Identifier: "HELLO_WORLD",
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD^}`,
+			want: Expression{
+				{Expansion: UppercaseFirstExpansion{
+					Identifier: "HELLO_WORLD",
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD^^[aeiou]}`,
+			want: Expression{
+				{Expansion: UppercaseAllExpansion{
+					Identifier: "HELLO_WORLD",
+					Pattern: Expression{
+						{Text: "[aeiou]"},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD,$PATTERN}`,
+			want: Expression{
+				{Expansion: LowercaseFirstExpansion{
+					Identifier: "HELLO_WORLD",
+					Pattern: Expression{
+						{Expansion: VariableExpansion{Identifier: "PATTERN"}},
+					},
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD,,}`,
+			want: Expression{
+				{Expansion: LowercaseAllExpansion{
+					Identifier: "HELLO_WORLD",
+				}},
+			},
+		},
+		{
+			input: `${!HELLO_WORLD}`,
+			want: Expression{
+				{Expansion: IndirectExpansion{
+					Identifier: "HELLO_WORLD",
+				}},
+			},
+		},
+		{
+			input: `${!HELLO*} ${!HELLO@}`,
+			want: Expression{
+				{Expansion: PrefixNamesExpansion{
+					Prefix: "HELLO",
+				}},
+				{Text: " "},
+				{Expansion: PrefixNamesExpansion{
+					Prefix: "HELLO",
+					At:     true,
+				}},
+			},
+		},
+		{
+			input: `${HELLO_WORLD@Q}`,
+			want: Expression{
+				{Expansion: TransformExpansion{
+					Identifier: "HELLO_WORLD",
+					Operator:   TransformQuote,
+				}},
+			},
+		},
 		{
 			input: `$${not actually a brace expression`,
 			want: Expression{
@@ -179,6 +413,34 @@ func TestParser(t *testing.T) {
 				{Text: "echo hello world)"},
 			},
 		},
+		{
+			input: "$(( (HELLO + 1) * $WORLD ))",
+			want: Expression{
+				{Expansion: ArithmeticExpansion{
+					Content: Expression{
+						{Text: " "},
+						{Text: "("},
+						{Text: "HELLO + 1"},
+						{Text: ")"},
+						{Text: " * "},
+						{Expansion: VariableExpansion{Identifier: "WORLD"}},
+						{Text: " "},
+					},
+				}},
+			},
+		},
+		{
+			input: "$1.00 ${10} $# ${@}",
+			want: Expression{
+				{Expansion: PositionalExpansion{Index: 1}},
+				{Text: ".00 "},
+				{Expansion: PositionalExpansion{Index: 10, Braced: true}},
+				{Text: " "},
+				{Expansion: SpecialExpansion{Name: '#'}},
+				{Text: " "},
+				{Expansion: SpecialExpansion{Name: '@', Braced: true}},
+			},
+		},
 		{
 			input: "$$MOUNTAIN",
 			want: Expression{
@@ -213,9 +475,270 @@ func TestParser(t *testing.T) {
 				t.Fatalf("NewParser(%q).Parse() error = %v", tc.input, err)
 			}
 
-			if diff := cmp.Diff(got, tc.want); diff != "" {
+			if diff := cmp.Diff(got, tc.want, ignoreSpans); diff != "" {
+				t.Errorf("parsed expression diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParserWithCommandSubstitution(t *testing.T) {
+	t.Parallel()
+
+	opts := Options{CommandRunner: CommandRunnerFunc(func(string, Env) (string, error) { return "", nil })}
+
+	testCases := []struct {
+		input string
+		want  Expression
+	}{
+		{
+			input: "$(echo hello world)",
+			want: Expression{
+				{Expansion: CommandExpansion{Command: "echo hello world"}},
+			},
+		},
+		{
+			input: `$(echo "$(echo ")")" | tr -d '(')!`,
+			want: Expression{
+				{Expansion: CommandExpansion{Command: `echo "$(echo ")")" | tr -d '('`}},
+				{Text: "!"},
+			},
+		},
+		{
+			input: "Hello `echo \\$USER \\` \\\\ \\n`",
+			want: Expression{
+				{Text: "Hello "},
+				{Expansion: CommandExpansion{Command: "echo $USER ` \\ \\n", Backquoted: true}},
+			},
+		},
+		{
+			input: "$((echo hello); (echo world))",
+			want: Expression{
+				{Expansion: CommandExpansion{Command: "(echo hello); (echo world)"}},
+			},
+		},
+		{
+			input: "\\`echo hello\\`",
+			want: Expression{
+				{Expansion: EscapedBackquoteExpansion{}},
+				{Text: "echo hello"},
+				{Expansion: EscapedBackquoteExpansion{}},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := NewParserWithOptions(tc.input, opts).Parse()
+			if err != nil {
+				t.Fatalf("NewParserWithOptions(%q).Parse() error = %v", tc.input, err)
+			}
+
+			if diff := cmp.Diff(got, tc.want, ignoreSpans); diff != "" {
 				t.Errorf("parsed expression diff (-got +want):\n%s", diff)
 			}
 		})
 	}
 }
+
+func TestParserRespectingQuotes(t *testing.T) {
+	t.Parallel()
+
+	opts := Options{RespectQuotes: true}
+
+	testCases := []struct {
+		input string
+		want  Expression
+	}{
+		{
+			input: `echo '$HOME' "$HOME"`,
+			want: Expression{
+				{Text: "echo "},
+				{Text: "'$HOME'"},
+				{Text: " "},
+				{Text: `"`},
+				{Expansion: VariableExpansion{Identifier: "HOME"}},
+				{Text: `"`},
+			},
+		},
+		{
+			input: `$'\'$HOME'\"`,
+			want: Expression{
+				{Text: `$'\'$HOME'`},
+				{Text: `\"`},
+			},
+		},
+		{
+			input: `"it's ${NAME:-"you"}"`,
+			want: Expression{
+				{Text: `"`},
+				{Text: "it's "},
+				{Expansion: EmptyValueExpansion{
+					Identifier: "NAME",
+					Content:    Expression{{Text: `"you"`}},
+				}},
+				{Text: `"`},
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			t.Parallel()
+
+			got, err := NewParserWithOptions(tc.input, opts).Parse()
+			if err != nil {
+				t.Fatalf("NewParserWithOptions(%q).Parse() error = %v", tc.input, err)
+			}
+
+			if diff := cmp.Diff(got, tc.want, ignoreSpans); diff != "" {
+				t.Errorf("parsed expression diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestParserSpans(t *testing.T) {
+	t.Parallel()
+
+	input := `echo ${GREETING:-hello $NAME} \\$$HOME 🦀 $((1 + (2)))`
+	got, err := NewParser(input).Parse()
+	if err != nil {
+		t.Fatalf("NewParser(%q).Parse() error = %v", input, err)
+	}
+
+	want := Expression{
+		{Text: "echo ", Span: Span{0, 5}},
+		{Expansion: EmptyValueExpansion{
+			Identifier: "GREETING",
+			Content: Expression{
+				{Text: "hello ", Span: Span{17, 23}},
+				{Expansion: VariableExpansion{Identifier: "NAME"}, Span: Span{23, 28}},
+			},
+		}, Span: Span{5, 29}},
+		{Text: " ", Span: Span{29, 30}},
+		{Text: `\\`, Span: Span{30, 32}},
+		{Expansion: EscapedExpansion{PotentialIdentifier: "HOME"}, Span: Span{32, 34}},
+		{Text: "HOME 🦀 ", Span: Span{34, 44}},
+		{Expansion: ArithmeticExpansion{
+			Content: Expression{
+				{Text: "1 + ", Span: Span{47, 51}},
+				{Text: "(", Span: Span{51, 52}},
+				{Text: "2", Span: Span{52, 53}},
+				{Text: ")", Span: Span{53, 54}},
+			},
+		}, Span: Span{44, 56}},
+	}
+
+	if diff := cmp.Diff(got, want); diff != "" {
+		t.Errorf("parsed expression diff (-got +want):\n%s", diff)
+	}
+
+	for _, item := range got {
+		if item.Text != "" && item.Text != input[item.Span.Start:item.Span.End] {
+			t.Errorf("text %q has span %v, which is %q", item.Text, item.Span, input[item.Span.Start:item.Span.End])
+		}
+	}
+}
+
+func TestExpressionString(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		input string
+		want  string
+	}{
+		{input: "Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}", want: "Buildkite... $HELLO_WORLD ${ANOTHER_VAR:-🏖}"},
+		{input: "${HELLO}_WORLD $HELLO-world ${HELLO}🦀", want: "${HELLO}_WORLD $HELLO-world $HELLO🦀"},
+		{input: "${A-$B} ${A:=${B:+c}} ${A=} ${A+b} ${A?} ${A:?not $B}"},
+		{input: "${A#*.} ${A##*.} ${A%.*} ${A%%.*}"},
+		{input: "${A/a} ${A/a/} ${A//\\//-} ${A/#a/b} ${A/%a/$B}", want: "${A/a} ${A/a} ${A//\\//-} ${A/#a/b} ${A/%a/$B}"},
+		{input: "${A^} ${A^^[ab]} ${A,} ${A,,}"},
+		{input: "${#A} ${!A} ${!A*} ${!A@} ${A@Q} ${A@u}"},
+		{input: "${A:1} ${A: -3:2} ${A:1:-1} ${A:2:3}"},
+		{input: "$1 ${10} ${2} $# ${@} $*"},
+		{input: "$((1 + (A * $B))) $(echo hello)"},
+		{input: "$$HOME \\$HOME \\\\$HOME $", want: "$$HOME $$HOME \\\\$HOME $"},
+		{input: "${\\}$$HOME ${A:-${\\}}"},
+		{input: "$\\$A $$$A $ $$", want: "$\\$A $$$A $ $$"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.input, func(t *testing.T) {
+			t.Parallel()
+
+			want := tc.want
+			if want == "" {
+				want = tc.input
+			}
+
+			expr, err := NewParser(tc.input).Parse()
+			if err != nil {
+				t.Fatalf("NewParser(%q).Parse() error = %v", tc.input, err)
+			}
+			if got := expr.String(); got != want {
+				t.Fatalf("Expression.String() = %q, want %q", got, want)
+			}
+
+			reparsed, err := NewParser(want).Parse()
+			if err != nil {
+				t.Fatalf("NewParser(%q).Parse() error = %v", want, err)
+			}
+			if diff := cmp.Diff(reparsed, expr, ignoreSpans); diff != "" {
+				t.Errorf("reparsed expression diff (-got +want):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestExpressionStringWithCommandSubstitution(t *testing.T) {
+	t.Parallel()
+
+	opts := Options{CommandRunner: CommandRunnerFunc(func(string, Env) (string, error) { return "", nil })}
+
+	for _, tc := range []struct {
+		input string
+		want  string
+	}{
+		{input: `$(echo "$(echo ')')")`, want: `$(echo "$(echo ')')")`},
+		{input: "`echo \\$HOME \\` \\\\ \\n \\\\\\$`", want: "`echo $HOME \\` \\ \\n \\\\$`"},
+		{input: "echo \\`date\\` `date`", want: "echo \\`date\\` `date`"},
+	} {
+		expr, err := NewParserWithOptions(tc.input, opts).Parse()
+		if err != nil {
+			t.Fatalf("NewParserWithOptions(%q).Parse() error = %v", tc.input, err)
+		}
+		if got := expr.String(); got != tc.want {
+			t.Errorf("Expression.String() = %q, want %q", got, tc.want)
+		}
+
+		reparsed, err := NewParserWithOptions(expr.String(), opts).Parse()
+		if err != nil {
+			t.Fatalf("NewParserWithOptions(%q).Parse() error = %v", expr.String(), err)
+		}
+		if diff := cmp.Diff(reparsed, expr, ignoreSpans); diff != "" {
+			t.Errorf("reparsed expression diff (-got +want):\n%s", diff)
+		}
+	}
+}
+
+func TestParsingUnclosedArithmeticTakesLinearSteps(t *testing.T) {
+	t.Parallel()
+
+	for _, str := range []string{
+		strings.Repeat("$((", 20),
+		strings.Repeat("$((", 20) + "$((1 + 2))",
+		strings.Repeat("$((1)x ", 20),
+		strings.Repeat("$(( ${A:-(", 20),
+	} {
+		p := NewParser(str)
+		_, _ = p.Parse()
+
+		// trying every way of nesting them would take billions of steps
+		if limit := 100 * len(str); p.steps > limit {
+			t.Errorf("Parsing %q took %d steps, want at most %d", str, p.steps, limit)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package interpolate
+
+import (
+	"strings"
+)
+
+// PartialInterpolate is like Interpolate, but only expands what it can with the variables in env,
+// for when the rest aren't known until later. Expansions that use a variable env doesn't have are
+// left as they're written, including anything nested within them, and everything else is escaped.
+// Interpolating the result later, once the rest of the variables are known too, gives the same result
+// as interpolating str once with all of them.
+func PartialInterpolate(env Env, str string) (string, error) {
+	if env == nil {
+		env = NewSliceEnv(nil)
+	}
+	expr, err := NewParser(str).Parse()
+	if err != nil {
+		return "", err
+	}
+	return expr.PartialExpand(env)
+}
+
+// PartialExpand is like Expand, but leaves expansions that use variables env doesn't have as they're
+// written, as PartialInterpolate does. The values of the variables env does have are assumed not to
+// change before the result is interpolated again.
+func (e Expression) PartialExpand(env Env) (string, error) {
+	var buf, text strings.Builder
+
+	for _, item := range e {
+		if item.Expansion == nil {
+			text.WriteString(item.Text)
+			continue
+		}
+
+		pe := &partialEnv{Env: env}
+		result, err := item.Expansion.Expand(pe)
+		if pe.missing {
+			// every expansion starts with a $, so any backslashes before it need escaping
+			writeEscaped(&buf, text.String(), true)
+			text.Reset()
+			buf.WriteString(item.String())
+			continue
+		}
+		if err != nil {
+			return "", withSpan(err, item.Span)
+		}
+		text.WriteString(result)
+	}
+
+	writeEscaped(&buf, text.String(), false)
+	return buf.String(), nil
+}
+
+// partialEnv records whether expanding something needed anything its Env doesn't have, in which
+// case the expansion is left to be done later
+type partialEnv struct {
+	Env
+	missing bool
+}
+
+func (e *partialEnv) Get(key string) (string, bool) {
+	val, ok := e.Env.Get(key)
+	if !ok {
+		e.missing = true
+	}
+	return val, ok
+}
+
+// Set only assigns when nothing was missing, as otherwise the assignment is done later instead
+func (e *partialEnv) Set(key, value string) {
+	mutable, ok := e.Env.(MutableEnv)
+	if !ok || e.missing {
+		e.missing = true
+		return
+	}
+	mutable.Set(key, value)
+}
+
+// Keys counts as missing, as there could be more keys by the time the expansion is done later
+func (e *partialEnv) Keys() []string {
+	e.missing = true
+	return nil
+}
+
+func (e *partialEnv) Args() []string {
+	if argsEnv, ok := e.Env.(ArgsEnv); ok {
+		return argsEnv.Args()
+	}
+	e.missing = true
+	return nil
+}
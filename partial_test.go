@@ -0,0 +1,96 @@
+package interpolate_test
+
+import (
+	"testing"
+
+	"github.com/buildkite/interpolate"
+)
+
+func TestPartialInterpolate(t *testing.T) {
+	t.Parallel()
+
+	known := map[string]string{
+		"BUILD":     "42",
+		"BRANCH":    "main",
+		"EMPTY":     "",
+		"PRICE":     "$5",
+		"REGEX":     `^\$\d+\\`,
+		"DIR":       `C:\`,
+		"NAME_VAR":  "BRANCH",
+		"LATER_VAR": "AGENT",
+	}
+	later := map[string]string{
+		"AGENT":     "agent-1",
+		"QUEUE":     "default",
+		"EMPTY_TOO": "",
+	}
+
+	for _, tc := range []struct {
+		Str     string
+		Partial string
+	}{
+		{`build $BUILD on $BRANCH`, `build 42 on main`},
+		{`$AGENT`, `${AGENT}`},
+		{`${BRANCH}_$AGENT`, `main_${AGENT}`},
+		{`$AGENT-$BUILD`, `${AGENT}-42`},
+		{`${AGENT:-unknown} ${QUEUE/def/x}`, `${AGENT:-unknown} ${QUEUE/def/x}`},
+		{`${MISSING:-${BRANCH:0:2}}`, `${MISSING:-${BRANCH:0:2}}`},
+		{`${BRANCH:-$MISSING}`, `main`},
+		{`${EMPTY:+$MISSING}${EMPTY_TOO:-x}`, `${EMPTY_TOO:-x}`},
+		{`$PRICE$AGENT`, `$$5${AGENT}`},
+		{`$REGEX`, `^${\}$$\d+\\`},
+		{`$REGEX$AGENT`, `^${\}$$\d+\\${AGENT}`},
+		{`$DIR$AGENT`, `C:${\}${AGENT}`},
+		{`\\$AGENT`, `\\${AGENT}`},
+		{`$$BUILD \$AGENT`, `$$BUILD $$AGENT`},
+		{`${!NAME_VAR} ${!LATER_VAR}`, `main ${!LATER_VAR}`},
+		{`${!BUILD*}`, `${!BUILD*}`},
+		{`$((BUILD + 1)) $((AGENT + 1))`, `43 $((AGENT + 1))`},
+		{`$1 $#`, `$1 $#`},
+		{`${AGENT?} ${EMPTY?}`, `${AGENT?} `},
+		{`echo 'xi$$' | grep ${BRANCH^^}`, `echo 'xi$$' | grep MAIN`},
+	} {
+		result, err := interpolate.PartialInterpolate(interpolate.NewMapEnv(known), tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != tc.Partial {
+			t.Fatalf("Test %q failed: Expected partial result %q, got %q", tc.Str, tc.Partial, result)
+		}
+
+		// interpolating the rest later gives the same result as doing it all at once
+		all := map[string]string{}
+		for k, v := range known {
+			all[k] = v
+		}
+		for k, v := range later {
+			all[k] = v
+		}
+		expected, err := interpolate.Interpolate(interpolate.NewMapEnv(all), tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err = interpolate.Interpolate(interpolate.NewMapEnv(all), result)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result != expected {
+			t.Fatalf("Test %q failed: Expected %q after interpolating the rest, got %q", tc.Str, expected, result)
+		}
+	}
+}
+
+func TestPartialInterpolateErrors(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{"EMPTY": ""})
+
+	// errors that would happen whatever the other variables are set to are returned straight away
+	if _, err := interpolate.PartialInterpolate(environ, `${EMPTY:?needs a value}`); err == nil ||
+		err.Error() != "$EMPTY: needs a value" {
+		t.Fatalf("Expected error %q, got %v", "$EMPTY: needs a value", err)
+	}
+	if _, err := interpolate.PartialInterpolate(environ, `${MISSING`); err == nil {
+		t.Fatalf("Expected a parse error, got nil")
+	}
+}
@@ -0,0 +1,433 @@
+package interpolate
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Patterns are shell glob patterns, as used by bash when matching in expansions like ${VAR#pattern}.
+// A * matches any string (including an empty one), a ? matches any single character and [...] matches
+// any one of the enclosed characters. A backslash matches the character after it literally.
+//
+// Matching is done on runes rather than bytes, so a ? will match a single multi-byte character.
+
+// matchPattern reports whether the whole of str matches pattern
+func matchPattern(pattern, str string) bool {
+	px, sx := 0, 0
+
+	// Where to resume after a failed match, if we've seen a * we can extend
+	nextPx, nextSx := -1, -1
+
+	for px < len(pattern) || sx < len(str) {
+		if px < len(pattern) {
+			c, size := utf8.DecodeRuneInString(pattern[px:])
+			switch c {
+			case '*':
+				// Try to match zero characters first, and come back to consume more if that fails
+				nextPx, nextSx = px, sx
+				px += size
+				continue
+
+			case '?':
+				if sx < len(str) {
+					_, ssize := utf8.DecodeRuneInString(str[sx:])
+					px += size
+					sx += ssize
+					continue
+				}
+
+			case '[':
+				if sx < len(str) {
+					r, ssize := utf8.DecodeRuneInString(str[sx:])
+					if matched, width, ok := matchClass(pattern[px:], r); ok {
+						if matched {
+							px += width
+							sx += ssize
+							continue
+						}
+						break
+					}
+				}
+				// An unterminated class is just a literal [
+				if sx < len(str) && str[sx] == '[' {
+					px += size
+					sx++
+					continue
+				}
+
+			default:
+				if c == '\\' && px+size < len(pattern) {
+					px += size
+					c, size = utf8.DecodeRuneInString(pattern[px:])
+				}
+				if sx < len(str) && strings.HasPrefix(str[sx:], pattern[px:px+size]) {
+					px += size
+					sx += size
+					continue
+				}
+			}
+		}
+
+		// Mismatch, so backtrack to the last * and let it consume one more character
+		if nextSx >= 0 && nextSx < len(str) {
+			_, ssize := utf8.DecodeRuneInString(str[nextSx:])
+			px = nextPx
+			sx = nextSx + ssize
+			continue
+		}
+		return false
+	}
+
+	return true
+}
+
+// posixClasses are the character classes supported inside brackets, like [[:alpha:]]
+var posixClasses = map[string]func(rune) bool{
+	"alnum":  func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) },
+	"alpha":  unicode.IsLetter,
+	"blank":  func(r rune) bool { return r == ' ' || r == '\t' },
+	"cntrl":  unicode.IsControl,
+	"digit":  unicode.IsDigit,
+	"graph":  func(r rune) bool { return unicode.IsGraphic(r) && !unicode.IsSpace(r) },
+	"lower":  unicode.IsLower,
+	"print":  unicode.IsPrint,
+	"punct":  unicode.IsPunct,
+	"space":  unicode.IsSpace,
+	"upper":  unicode.IsUpper,
+	"word":   func(r rune) bool { return unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' },
+	"xdigit": func(r rune) bool { return strings.ContainsRune("0123456789abcdefABCDEF", r) },
+}
+
+// matchClass matches r against the bracket expression at the start of pattern. It returns whether it
+// matched, the width of the bracket expression in bytes, and false if the expression is unterminated.
+func matchClass(pattern string, r rune) (matched bool, width int, ok bool) {
+	pos := 1 // skip the [
+
+	negate := false
+	if pos < len(pattern) && (pattern[pos] == '!' || pattern[pos] == '^') {
+		negate = true
+		pos++
+	}
+
+	for first := true; pos < len(pattern); first = false {
+		// A ] closes the class, unless it's the first character in it
+		if pattern[pos] == ']' && !first {
+			return matched != negate, pos + 1, true
+		}
+
+		if strings.HasPrefix(pattern[pos:], "[:") {
+			if end := strings.Index(pattern[pos+2:], ":]"); end >= 0 {
+				if class, ok := posixClasses[pattern[pos+2:pos+2+end]]; ok {
+					if class(r) {
+						matched = true
+					}
+					pos += end + 4
+					continue
+				}
+			}
+		}
+
+		lo, size := utf8.DecodeRuneInString(pattern[pos:])
+		if lo == '\\' && pos+size < len(pattern) {
+			pos += size
+			lo, size = utf8.DecodeRuneInString(pattern[pos:])
+		}
+		pos += size
+
+		hi := lo
+		if pos+1 < len(pattern) && pattern[pos] == '-' && pattern[pos+1] != ']' {
+			pos++
+			hi, size = utf8.DecodeRuneInString(pattern[pos:])
+			if hi == '\\' && pos+size < len(pattern) {
+				pos += size
+				hi, size = utf8.DecodeRuneInString(pattern[pos:])
+			}
+			pos += size
+		}
+
+		if lo <= r && r <= hi {
+			matched = true
+		}
+	}
+
+	return false, 0, false
+}
+
+// runeBoundaries returns the byte offsets of the start of every rune in str, plus the end of str
+func runeBoundaries(str string) []int {
+	boundaries := make([]int, 0, len(str)+1)
+	for i := range str {
+		boundaries = append(boundaries, i)
+	}
+	return append(boundaries, len(str))
+}
+
+// patternMatcher finds where a pattern matches within str. Rather than trying to match the pattern
+// against every substring, it runs over str once keeping track of every position in the pattern that
+// the characters so far could have got to, so it takes time proportional to the length of str times
+// the length of the pattern however the pattern is made up.
+type patternMatcher struct {
+	str    string
+	tokens []string // the pattern split into *s and whatever matches a single character
+
+	// boundary records which offsets in str are the start of a rune or the end of str, as matches can
+	// only start and end at those
+	boundary []bool
+
+	// limit is the latest a match can start, which scan lowers when it's told a later match is no use
+	limit int
+
+	// steps counts how many times scan has tried to take a match further, which tests use to check it
+	// doesn't try too many
+	steps int
+}
+
+func newPatternMatcher(str, pattern string) *patternMatcher {
+	m := &patternMatcher{str: str, boundary: make([]bool, len(str)+1)}
+	for _, i := range runeBoundaries(str) {
+		m.boundary[i] = true
+	}
+	for px := 0; px < len(pattern); {
+		width := patternCharWidth(pattern[px:])
+		// a run of *s matches the same as a single one
+		if pattern[px] != '*' || len(m.tokens) == 0 || m.tokens[len(m.tokens)-1] != "*" {
+			m.tokens = append(m.tokens, pattern[px:px+width])
+		}
+		px += width
+	}
+	return m
+}
+
+// patternCharWidth returns the width in bytes of the * or whatever matches a single character at the
+// start of pattern, which is a literal character (possibly escaped), a ? or a bracket expression
+func patternCharWidth(pattern string) int {
+	_, size := utf8.DecodeRuneInString(pattern)
+	switch pattern[0] {
+	case '\\':
+		if size < len(pattern) {
+			_, next := utf8.DecodeRuneInString(pattern[size:])
+			return size + next
+		}
+	case '[':
+		if _, width, ok := matchClass(pattern, 0); ok {
+			return width
+		}
+	}
+	return size
+}
+
+// matchToken matches a token other than a * against the start of str, the same way as matchPattern,
+// returning how many bytes of str it matched
+func matchToken(token, str string) (size int, ok bool) {
+	if str == "" {
+		return 0, false
+	}
+	switch {
+	case token == "?":
+		_, size := utf8.DecodeRuneInString(str)
+		return size, true
+	case token[0] == '[' && len(token) > 1:
+		r, size := utf8.DecodeRuneInString(str)
+		matched, _, _ := matchClass(token, r)
+		return size, matched
+	case token[0] == '\\' && len(token) > 1:
+		token = token[1:]
+	}
+	return len(token), strings.HasPrefix(str, token)
+}
+
+// scan matches the pattern against str, starting from offset from and, unless anchored is set, from every
+// rune boundary after it too. Whenever matches end at an offset, it calls found with that offset and where
+// the earliest (or if latest is set, the latest) of them started, stopping if found returns false.
+func (m *patternMatcher) scan(from int, anchored, latest bool, found func(start, end int) bool) {
+	// Each of the pending offsets in str has a row recording, for each token in the pattern, where the
+	// match that got up to that token started, if any did. A token never matches more than a single
+	// rune, or in the case of an escaped character, the same number of bytes, so there are only ever
+	// that many offsets ahead that matches could have got to.
+	var rows [utf8.UTFMax + 1][]int
+	for i := range rows {
+		rows[i] = make([]int, len(m.tokens)+1)
+		for k := range rows[i] {
+			rows[i][k] = -1
+		}
+	}
+	furthest := -1 // the furthest offset any match has got to
+	m.limit = len(m.str)
+
+	// add records that a match that started at start got up to token k at offset pos
+	add := func(pos, k, start int) {
+		row := rows[pos%len(rows)]
+		for {
+			if cur := row[k]; cur >= 0 && (latest && cur >= start || !latest && cur <= start) {
+				return
+			}
+			row[k] = start
+			furthest = max(furthest, pos)
+			// a * can match nothing, so the match gets past it straight away
+			if k == len(m.tokens) || m.tokens[k] != "*" {
+				return
+			}
+			k++
+		}
+	}
+
+	for pos := from; pos <= len(m.str); pos++ {
+		if m.boundary[pos] && pos <= m.limit && (pos == from || !anchored) {
+			add(pos, 0, pos)
+		} else if pos > furthest && (anchored || pos > m.limit) {
+			return
+		}
+
+		row := rows[pos%len(rows)]
+		for k, start := range row {
+			if start < 0 {
+				continue
+			}
+			row[k] = -1
+			m.steps++
+			switch {
+			case start > m.limit:
+			case k == len(m.tokens):
+				if m.boundary[pos] && !found(start, pos) {
+					return
+				}
+			case pos == len(m.str):
+			case m.tokens[k] == "*":
+				_, size := utf8.DecodeRuneInString(m.str[pos:])
+				add(pos+size, k, start)
+			default:
+				if size, ok := matchToken(m.tokens[k], m.str[pos:]); ok {
+					add(pos+size, k+1, start)
+				}
+			}
+		}
+	}
+}
+
+// trimPrefixPattern removes the shortest (or longest) prefix of str that matches pattern
+func trimPrefixPattern(str, pattern string, longest bool) string {
+	end := -1
+	newPatternMatcher(str, pattern).scan(0, true, false, func(_, e int) bool {
+		end = e
+		return longest
+	})
+	if end < 0 {
+		return str
+	}
+	return str[end:]
+}
+
+// trimSuffixPattern removes the shortest (or longest) suffix of str that matches pattern
+func trimSuffixPattern(str, pattern string, longest bool) string {
+	start := -1
+	newPatternMatcher(str, pattern).scan(0, false, !longest, func(s, e int) bool {
+		if e == len(str) {
+			start = s
+		}
+		return true
+	})
+	if start < 0 {
+		return str
+	}
+	return str[:start]
+}
+
+// find returns the leftmost, longest match of the pattern in str that starts at or after from
+func (m *patternMatcher) find(from int) (start, end int, ok bool) {
+	m.scan(from, false, false, func(s, e int) bool {
+		// Only an empty string can have an empty match at its end
+		if s == len(m.str) && s > 0 {
+			return true
+		}
+		if !ok || s < start || (s == start && e > end) {
+			start, end, ok = s, e, true
+			// a match starting any later is no use now
+			m.limit = s
+		}
+		return true
+	})
+	return start, end, ok
+}
+
+// replacePattern replaces the first (or every) leftmost, longest match of pattern in str
+func replacePattern(str, pattern, replacement string, all bool) string {
+	if pattern == "" {
+		return str
+	}
+
+	var buf strings.Builder
+	m := newPatternMatcher(str, pattern)
+	from := 0
+	for from <= len(str) {
+		start, end, ok := m.find(from)
+		if !ok {
+			break
+		}
+		buf.WriteString(str[from:start])
+		buf.WriteString(replacement)
+		from = end
+		if !all || start == end {
+			break
+		}
+	}
+	buf.WriteString(str[from:])
+
+	return buf.String()
+}
+
+// replacePrefixPattern replaces the longest prefix of str that matches pattern
+func replacePrefixPattern(str, pattern, replacement string) string {
+	end := -1
+	newPatternMatcher(str, pattern).scan(0, true, false, func(_, e int) bool {
+		end = e
+		return true
+	})
+	if end < 0 {
+		return str
+	}
+	return replacement + str[end:]
+}
+
+// replaceSuffixPattern replaces the longest suffix of str that matches pattern
+func replaceSuffixPattern(str, pattern, replacement string) string {
+	start := -1
+	newPatternMatcher(str, pattern).scan(0, false, false, func(s, e int) bool {
+		if e == len(str) {
+			start = s
+		}
+		return true
+	})
+	if start < 0 {
+		return str
+	}
+	return str[:start] + replacement
+}
+
+// convertCase applies mapping to the first (or every) character of str that matches pattern. An empty
+// pattern matches any character.
+func convertCase(str, pattern string, mapping func(rune) rune, all bool) string {
+	if pattern == "" {
+		pattern = "?"
+	}
+
+	var buf strings.Builder
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		if r == utf8.RuneError && size <= 1 {
+			// leave invalid bytes alone
+			buf.WriteString(str[i : i+size])
+		} else if matchPattern(pattern, str[i:i+size]) {
+			buf.WriteRune(mapping(r))
+		} else {
+			buf.WriteString(str[i : i+size])
+		}
+		i += size
+
+		if !all {
+			buf.WriteString(str[i:])
+			break
+		}
+	}
+	return buf.String()
+}
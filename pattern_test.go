@@ -0,0 +1,88 @@
+package interpolate
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchPattern(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		pattern string
+		str     string
+		want    bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"*", "", true},
+		{"*", "anything/at/all", true},
+		{"a*c", "abbbc", true},
+		{"a*c", "abbbd", false},
+		{"*.tar.gz", "output.tar.gz", true},
+		{"*a*a*a*a", "banana", false},
+		{"*an*a", "banana", true},
+		{"?", "🦀", true},
+		{"??", "🦀", false},
+		{"[abc]", "b", true},
+		{"[abc]", "d", false},
+		{"[!abc]", "d", true},
+		{"[^abc]", "a", false},
+		{"[a-z]x", "qx", true},
+		{"[a-z]x", "Qx", false},
+		{"[]]", "]", true},
+		{"[a-]", "-", true},
+		{"[[:digit:]][[:upper:]]", "7Q", true},
+		{"[[:space:]]", "x", false},
+		{"[abc", "[abc", true},
+		{`\*`, "*", true},
+		{`\*`, "a", false},
+		{`[\]]`, "]", true},
+		{`\\`, `\`, true},
+	} {
+		if got := matchPattern(tc.pattern, tc.str); got != tc.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tc.pattern, tc.str, got, tc.want)
+		}
+	}
+}
+
+func TestPatternMatchingTakesLinearSteps(t *testing.T) {
+	t.Parallel()
+
+	msg := strings.Repeat(`say "hi" `, 2500)
+	letters := strings.Repeat("a", 3000)
+
+	for _, tc := range []struct {
+		pattern string
+		str     string
+	}{
+		{`"`, msg},
+		{`*"`, msg},
+		{`"*`, msg},
+		{`*x`, msg},
+		{`*b`, letters},
+		{`a*b`, letters},
+		{`a*b*a`, letters},
+		{`a?`, letters},
+		{`?*b`, letters},
+	} {
+		m := newPatternMatcher(tc.str, tc.pattern)
+
+		// find every match, as replacing them all does, then scan all of str as trimming a suffix does
+		for from := 0; from <= len(tc.str); {
+			start, end, ok := m.find(from)
+			if !ok || start == end {
+				break
+			}
+			from = end
+		}
+		m.scan(0, false, false, func(start, end int) bool { return true })
+
+		// a few steps per character and token, rather than per pair of characters
+		if limit := 4 * (len(tc.str) + 1) * (len(m.tokens) + 1); m.steps > limit {
+			t.Errorf("Matching %q took %d steps, want at most %d", tc.pattern, m.steps, limit)
+		}
+	}
+}
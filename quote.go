@@ -0,0 +1,219 @@
+package interpolate
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// These helpers implement the quoting and unquoting done by bash for ${VAR@Q} and ${VAR@E}. They are
+// written to produce exactly what bash does in a UTF-8 locale, so the output can be pasted into scripts.
+
+// shellQuote quotes str so that a shell would read it back as a single word with the same value.
+// Strings with unprintable characters are quoted as $'...' and everything else with single quotes.
+func shellQuote(str string) string {
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		if !isPrintable(r, size) {
+			return ansiCQuote(str)
+		}
+		i += size
+	}
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+// isPrintable reports whether bash considers the rune r (decoded from size bytes) printable, which is any
+// assigned character other than control characters and the line and paragraph separators
+func isPrintable(r rune, size int) bool {
+	if (r == utf8.RuneError && size <= 1) || unicode.Is(unicode.Cc, r) || r == '\u2028' || r == '\u2029' {
+		return false
+	}
+	return unicode.IsGraphic(r) || unicode.In(r, unicode.Cf, unicode.Co)
+}
+
+// ansiCQuote quotes str as a $'...' string, escaping unprintable bytes
+func ansiCQuote(str string) string {
+	var buf strings.Builder
+	buf.WriteString("$'")
+
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+
+		switch r {
+		case '\x1b':
+			buf.WriteString(`\E`)
+		case '\a':
+			buf.WriteString(`\a`)
+		case '\v':
+			buf.WriteString(`\v`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\'':
+			buf.WriteString(`\'`)
+		default:
+			if !isPrintable(r, size) {
+				// every byte of an unprintable character is escaped as octal
+				for _, b := range []byte(str[i : i+size]) {
+					buf.WriteByte('\\')
+					buf.WriteByte('0' + b>>6&7)
+					buf.WriteByte('0' + b>>3&7)
+					buf.WriteByte('0' + b&7)
+				}
+			} else {
+				buf.WriteString(str[i : i+size])
+			}
+		}
+		i += size
+	}
+
+	buf.WriteString("'")
+	return buf.String()
+}
+
+// expandEscapes expands the backslash escape sequences in str, the same way as in a $'...' string
+func expandEscapes(str string) string {
+	var buf strings.Builder
+
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c != '\\' || i+1 == len(str) {
+			buf.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch c = str[i]; c {
+		case 'a':
+			buf.WriteByte('\a')
+		case 'b':
+			buf.WriteByte('\b')
+		case 'e', 'E':
+			buf.WriteByte('\x1b')
+		case 'f':
+			buf.WriteByte('\f')
+		case 'n':
+			buf.WriteByte('\n')
+		case 'r':
+			buf.WriteByte('\r')
+		case 't':
+			buf.WriteByte('\t')
+		case 'v':
+			buf.WriteByte('\v')
+		case '\\', '\'', '"', '?':
+			buf.WriteByte(c)
+
+		case '0', '1', '2', '3', '4', '5', '6', '7':
+			val, n := scanDigits(str[i:], 8, 3)
+			buf.WriteByte(byte(val))
+			i += n - 1
+
+		case 'x', 'u', 'U':
+			maxDigits := 2
+			if c == 'u' {
+				maxDigits = 4
+			} else if c == 'U' {
+				maxDigits = 8
+			}
+			val, n := scanDigits(str[i+1:], 16, maxDigits)
+			if n == 0 {
+				// not actually an escape, so leave it be
+				buf.WriteByte('\\')
+				buf.WriteByte(c)
+				continue
+			}
+			if c == 'x' {
+				buf.WriteByte(byte(val))
+			} else {
+				writeUTF8(&buf, val)
+			}
+			i += n
+
+		case 'c':
+			if i+1 == len(str) {
+				buf.WriteString(`\c`)
+				continue
+			}
+			i++
+			if str[i] == '?' {
+				buf.WriteByte(0x7f)
+			} else {
+				buf.WriteByte(byte(unicode.ToUpper(rune(str[i]))) & 0x1f)
+			}
+
+		default:
+			buf.WriteByte('\\')
+			buf.WriteByte(c)
+		}
+	}
+
+	// bash works with C strings, so nothing survives after a NUL
+	result := buf.String()
+	if nul := strings.IndexByte(result, 0); nul >= 0 {
+		result = result[:nul]
+	}
+	return result
+}
+
+// scanDigits parses up to maxDigits digits of the given base from the start of str, returning the value
+// and the number of digits used
+func scanDigits(str string, base uint32, maxDigits int) (uint32, int) {
+	var val uint32
+	n := 0
+	for ; n < maxDigits && n < len(str); n++ {
+		var digit uint32
+		switch c := str[n]; {
+		case '0' <= c && c <= '9':
+			digit = uint32(c - '0')
+		case 'a' <= c && c <= 'f':
+			digit = uint32(c-'a') + 10
+		case 'A' <= c && c <= 'F':
+			digit = uint32(c-'A') + 10
+		default:
+			digit = base
+		}
+		if digit >= base {
+			return val, n
+		}
+		val = val*base + digit
+	}
+	return val, n
+}
+
+// writeUTF8 writes the UTF-8 encoding of val to buf. Unlike utf8.EncodeRune, it encodes surrogates and
+// values beyond the Unicode range using the original UTF-8 scheme rather than replacing them, as bash does.
+func writeUTF8(buf *strings.Builder, val uint32) {
+	var n int
+	switch {
+	case val < 0x80:
+		buf.WriteByte(byte(val))
+		return
+	case val < 0x800:
+		n = 2
+	case val < 0x10000:
+		n = 3
+	case val < 0x200000:
+		n = 4
+	case val < 0x4000000:
+		n = 5
+	default:
+		n = 6
+	}
+
+	encoded := make([]byte, n)
+	for i := n - 1; i > 0; i-- {
+		encoded[i] = 0x80 | byte(val&0x3f)
+		val >>= 6
+	}
+	encoded[0] = byte(0xff<<(8-n)) | byte(val)&(0x7f>>n)
+	buf.Write(encoded)
+}
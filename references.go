@@ -0,0 +1,206 @@
+package interpolate
+
+// ReferenceKind is the kind of expansion a variable is referenced in
+type ReferenceKind string
+
+const (
+	ReferenceVariable      ReferenceKind = "variable"       // $VAR or ${VAR}
+	ReferenceDefault       ReferenceKind = "default"        // ${VAR:-word} or ${VAR-word}
+	ReferenceAssignDefault ReferenceKind = "assign-default" // ${VAR:=word} or ${VAR=word}
+	ReferenceAlternate     ReferenceKind = "alternate"      // ${VAR:+word} or ${VAR+word}
+	ReferenceRequired      ReferenceKind = "required"       // ${VAR:?message} or ${VAR?message}
+	ReferenceSubstring     ReferenceKind = "substring"      // ${VAR:offset:length}
+	ReferenceRemovePattern ReferenceKind = "remove-pattern" // ${VAR#pattern} and friends
+	ReferenceReplace       ReferenceKind = "replace"        // ${VAR/pattern/string} and friends
+	ReferenceLength        ReferenceKind = "length"         // ${#VAR}
+	ReferenceCase          ReferenceKind = "case"           // ${VAR^pattern} and friends
+	ReferenceIndirect      ReferenceKind = "indirect"       // ${!VAR}
+	ReferenceTransform     ReferenceKind = "transform"      // ${VAR@operator}
+	ReferenceArithmetic    ReferenceKind = "arithmetic"     // a bare name in $((expression))
+)
+
+// Reference is a reference to a variable within an expression
+type Reference struct {
+	Name string
+
+	// Kind is the kind of expansion the variable is referenced in, and Operator is the operator used
+	// in it as written, like ":-" for ${VAR:-word}. Operator is empty for $VAR, ${#VAR} and ${!VAR}.
+	Kind     ReferenceKind
+	Operator string
+
+	// Required is set when expanding fails if the variable isn't set (or with :?, is empty)
+	Required bool
+
+	// Optional is set when it's fine for the variable not to be set, either because a default or
+	// alternate value is used instead, or because the reference is within one of those and is only
+	// expanded in some cases. A required reference within a default value is both.
+	Optional bool
+
+	// HasDefault is set when there's a default value to use if the variable isn't set
+	HasDefault bool
+
+	// Depth is the number of expansions the reference is nested within, so it's 0 at the top level
+	Depth int
+
+	// Escaped is set for escaped references like $$VAR, which aren't expanded, but would be by
+	// interpolating the result again
+	Escaped bool
+
+	// Span is where in the input the expansion containing the reference was parsed from
+	Span Span
+}
+
+// References parses the variable references from any expansions in the provided string
+func References(str string) ([]Reference, error) {
+	expr, err := NewParser(str).Parse()
+	if err != nil {
+		return nil, err
+	}
+	return expr.References(), nil
+}
+
+// References returns every reference to a variable within the expression, including nested ones,
+// in the order they're written
+func (e Expression) References() []Reference {
+	return e.references(0, false)
+}
+
+func (e Expression) references(depth int, conditional bool) []Reference {
+	refs := []Reference{}
+
+	for _, item := range e {
+		switch exp := item.Expansion.(type) {
+		case nil:
+			continue
+
+		case EscapedExpansion:
+			refs = append(refs, escapedReferences(exp, item.Span)...)
+			continue
+
+		case ArithmeticExpansion:
+			// bare names in the text are references too
+			for _, child := range exp.Content {
+				if child.Expansion != nil {
+					refs = append(refs, Expression{child}.references(depth+1, conditional)...)
+					continue
+				}
+				names, offsets := arithmeticIdentifiers(child.Text)
+				for i, name := range names {
+					refs = append(refs, Reference{
+						Name:     name,
+						Kind:     ReferenceArithmetic,
+						Optional: conditional,
+						Depth:    depth + 1,
+						Span:     Span{Start: child.Span.Start + offsets[i], End: child.Span.Start + offsets[i] + len(name)},
+					})
+				}
+			}
+			continue
+		}
+
+		ref, ok := expansionReference(item.Expansion)
+		if !ok {
+			continue
+		}
+		ref.Optional = ref.Optional || conditional
+		ref.Depth = depth
+		ref.Span = item.Span
+		refs = append(refs, ref)
+
+		// the words in defaults, alternates and required messages are only expanded in some cases
+		if pe, ok := item.Expansion.(ParentExpansion); ok {
+			childConditional := conditional || ref.Kind == ReferenceDefault || ref.Kind == ReferenceAssignDefault ||
+				ref.Kind == ReferenceAlternate || ref.Kind == ReferenceRequired
+			for _, child := range pe.Children() {
+				refs = append(refs, child.references(depth+1, childConditional)...)
+			}
+		}
+	}
+
+	return refs
+}
+
+// expansionReference returns the reference made by a built-in expansion, without its position
+func expansionReference(exp Expansion) (Reference, bool) {
+	switch e := exp.(type) {
+	case VariableExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceVariable}, true
+	case EmptyValueExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceDefault, Operator: ":-", Optional: true, HasDefault: true}, true
+	case UnsetValueExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceDefault, Operator: "-", Optional: true, HasDefault: true}, true
+	case AssignDefaultExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceAssignDefault, Operator: checkEmptyOperator(e.CheckEmpty, "="),
+			Optional: true, HasDefault: true}, true
+	case AlternateValueExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceAlternate, Operator: checkEmptyOperator(e.CheckEmpty, "+"),
+			Optional: true}, true
+	case RequiredExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceRequired, Operator: checkEmptyOperator(e.CheckEmpty, "?"),
+			Required: true}, true
+	case SubstringExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceSubstring, Operator: ":"}, true
+	case RemovePrefixExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceRemovePattern, Operator: "#"}, true
+	case RemoveLongestPrefixExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceRemovePattern, Operator: "##"}, true
+	case RemoveSuffixExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceRemovePattern, Operator: "%"}, true
+	case RemoveLongestSuffixExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceRemovePattern, Operator: "%%"}, true
+	case ReplaceExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceReplace, Operator: "/"}, true
+	case ReplaceAllExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceReplace, Operator: "//"}, true
+	case ReplacePrefixExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceReplace, Operator: "/#"}, true
+	case ReplaceSuffixExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceReplace, Operator: "/%"}, true
+	case LengthExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceLength}, true
+	case UppercaseFirstExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceCase, Operator: "^"}, true
+	case UppercaseAllExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceCase, Operator: "^^"}, true
+	case LowercaseFirstExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceCase, Operator: ","}, true
+	case LowercaseAllExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceCase, Operator: ",,"}, true
+	case IndirectExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceIndirect}, true
+	case TransformExpansion:
+		return Reference{Name: e.Identifier, Kind: ReferenceTransform, Operator: "@" + string(e.Operator)}, true
+	}
+	return Reference{}, false
+}
+
+// checkEmptyOperator returns operator, with a : in front of it if it also checks for an empty value
+func checkEmptyOperator(checkEmpty bool, operator string) string {
+	if checkEmpty {
+		return ":" + operator
+	}
+	return operator
+}
+
+// escapedReferences returns the references that an escaped expansion would make once it's unescaped,
+// all marked as escaped
+func escapedReferences(e EscapedExpansion, span Span) []Reference {
+	if e.PotentialIdentifier == "" {
+		return nil
+	}
+
+	expr, err := NewParser("$" + e.PotentialIdentifier).Parse()
+	if err != nil {
+		return nil
+	}
+
+	// the potential identifier comes straight after the escape
+	span.End += len(e.PotentialIdentifier)
+
+	refs := expr.References()
+	for i := range refs {
+		refs[i].Escaped = true
+		refs[i].Span = span
+	}
+	return refs
+}
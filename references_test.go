@@ -0,0 +1,67 @@
+package interpolate_test
+
+import (
+	"testing"
+
+	"github.com/buildkite/interpolate"
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestReferences(t *testing.T) {
+	t.Parallel()
+
+	refs, err := interpolate.References(`$HOME ${TAG:+--tag=$TAG} ${DEPLOY_ENV:?needs $HELP} ${REGION:-${AWS_REGION?}} $$ESCAPED $((SHARDS * ${#QUEUE}))`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []interpolate.Reference{
+		{Name: "HOME", Kind: interpolate.ReferenceVariable, Span: interpolate.Span{Start: 0, End: 5}},
+		{Name: "TAG", Kind: interpolate.ReferenceAlternate, Operator: ":+", Optional: true, Span: interpolate.Span{Start: 6, End: 24}},
+		{Name: "TAG", Kind: interpolate.ReferenceVariable, Optional: true, Depth: 1, Span: interpolate.Span{Start: 19, End: 23}},
+		{Name: "DEPLOY_ENV", Kind: interpolate.ReferenceRequired, Operator: ":?", Required: true, Span: interpolate.Span{Start: 25, End: 51}},
+		{Name: "HELP", Kind: interpolate.ReferenceVariable, Optional: true, Depth: 1, Span: interpolate.Span{Start: 45, End: 50}},
+		{Name: "REGION", Kind: interpolate.ReferenceDefault, Operator: ":-", Optional: true, HasDefault: true, Span: interpolate.Span{Start: 52, End: 77}},
+		{Name: "AWS_REGION", Kind: interpolate.ReferenceRequired, Operator: "?", Required: true, Optional: true, Depth: 1, Span: interpolate.Span{Start: 62, End: 76}},
+		{Name: "ESCAPED", Kind: interpolate.ReferenceVariable, Escaped: true, Span: interpolate.Span{Start: 78, End: 87}},
+		{Name: "SHARDS", Kind: interpolate.ReferenceArithmetic, Depth: 1, Span: interpolate.Span{Start: 91, End: 97}},
+		{Name: "QUEUE", Kind: interpolate.ReferenceLength, Depth: 1, Span: interpolate.Span{Start: 100, End: 109}},
+	}
+
+	if diff := cmp.Diff(refs, expected); diff != "" {
+		t.Errorf("references diff (-got +want):\n%s", diff)
+	}
+}
+
+func TestReferenceOperators(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		Str      string
+		Kind     interpolate.ReferenceKind
+		Operator string
+	}{
+		{`${A}`, interpolate.ReferenceVariable, ``},
+		{`${A-}`, interpolate.ReferenceDefault, `-`},
+		{`${A:=}`, interpolate.ReferenceAssignDefault, `:=`},
+		{`${A=}`, interpolate.ReferenceAssignDefault, `=`},
+		{`${A+}`, interpolate.ReferenceAlternate, `+`},
+		{`${A:1:2}`, interpolate.ReferenceSubstring, `:`},
+		{`${A##*/}`, interpolate.ReferenceRemovePattern, `##`},
+		{`${A%.*}`, interpolate.ReferenceRemovePattern, `%`},
+		{`${A//a/b}`, interpolate.ReferenceReplace, `//`},
+		{`${A/#a}`, interpolate.ReferenceReplace, `/#`},
+		{`${A^^}`, interpolate.ReferenceCase, `^^`},
+		{`${A,}`, interpolate.ReferenceCase, `,`},
+		{`${!A}`, interpolate.ReferenceIndirect, ``},
+		{`${A@Q}`, interpolate.ReferenceTransform, `@Q`},
+	} {
+		refs, err := interpolate.References(tc.Str)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(refs) != 1 || refs[0].Name != "A" || refs[0].Kind != tc.Kind || refs[0].Operator != tc.Operator {
+			t.Fatalf("Test %q should have a %s reference with operator %q, got %+v", tc.Str, tc.Kind, tc.Operator, refs)
+		}
+	}
+}
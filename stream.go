@@ -0,0 +1,186 @@
+package interpolate
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"unicode/utf8"
+)
+
+// streamChunkSize is how much InterpolateStream reads at a time
+const streamChunkSize = 32 * 1024
+
+// streamMaxLookahead is how far past the start of an expansion InterpolateStream reads looking for
+// its end before giving up and parsing it as if the stream ended there
+const streamMaxLookahead = 1024 * 1024
+
+// InterpolateStream is like Interpolate, but reads the string to interpolate from r and writes the
+// result to w as it goes, rather than needing it all in memory at once. Only as much of the input as
+// is needed to parse the current expansion is kept, up to a limit: an expansion (or quoted string)
+// that hasn't ended a megabyte after it starts is parsed as if the stream ended there. Something like
+// a $(( that's never closed is then written as it is, the same as at the end of the input, while a
+// brace expansion is a *ParseError. That way memory use is bounded whatever the size of the input.
+//
+// Parse errors are a *ParseError with its position in the whole stream, although its Snippet only
+// contains the part of the line that hadn't been written yet. Expansion errors are a *StreamError
+// with the offset of the expansion that failed. Everything before the error has already been written.
+// With Options.ContinueOnError, failed expansions are returned as an *ExpansionErrors once the whole
+// stream has been written instead.
+func InterpolateStream(env Env, r io.Reader, w io.Writer) error {
+	return InterpolateStreamWithOptions(env, r, w, Options{})
+}
+
+// InterpolateStreamWithOptions is like InterpolateStream, but with options that change how the
+// stream is interpolated
+func InterpolateStreamWithOptions(env Env, r io.Reader, w io.Writer, opts Options) error {
+	if env == nil {
+		env = NewSliceEnv(nil)
+	}
+	s := &streamer{env: withOptions(env, opts), w: w, opts: opts}
+	return s.stream(r)
+}
+
+// streamer interpolates a stream a buffer at a time, keeping track of where it is in the stream
+type streamer struct {
+	env  Env
+	w    io.Writer
+	opts Options
+
+	offset int // the offset of the start of the buffer in the stream
+	line   int // the number of lines before the buffer
+	column int // the number of characters before the buffer on its first line
+
+	errs []*ExpansionError // the expansions that failed, with Options.ContinueOnError
+
+	steps int // how many steps parsing has taken, as counted by Parser
+}
+
+// stream interpolates everything read from r
+func (s *streamer) stream(r io.Reader) error {
+	var buf []byte
+	chunk := make([]byte, streamChunkSize)
+	wait := 0 // how much to buffer before parsing again
+	for {
+		n, readErr := r.Read(chunk)
+		buf = append(buf, chunk[:n]...)
+
+		atEOF := errors.Is(readErr, io.EOF)
+		if readErr != nil && !atEOF {
+			return readErr
+		}
+		if len(buf) < wait && !atEOF {
+			continue
+		}
+
+		consumed, err := s.interpolate(buf, atEOF)
+		if err != nil {
+			return err
+		}
+		buf = append(buf[:0], buf[consumed:]...)
+
+		// What's left starts with an expansion that needs more input. It's parsed again once there's
+		// twice as much of it, rather than after every read, so that a long one isn't parsed over and
+		// over from the start. Once it's longer than streamMaxLookahead it's parsed as it is, and so is
+		// anything else starting in the first streamMaxLookahead bytes.
+		wait = min(2*len(buf), 2*streamMaxLookahead)
+
+		if atEOF {
+			return expansionErrors(s.errs)
+		}
+	}
+}
+
+// interpolate parses and expands as much of buf as it can, returning how much it used. Unless atEOF
+// is set, expansions that reach the end of buf are left for when there's more input, unless they
+// start more than streamMaxLookahead bytes before it.
+func (s *streamer) interpolate(buf []byte, atEOF bool) (int, error) {
+	p := NewParserWithOptions(string(buf), s.opts)
+
+	for p.pos < len(p.input) {
+		start := p.pos
+		p.sawEnd = false
+
+		items, err := p.parseItem(nil, "")
+		if p.sawEnd && !atEOF {
+			if len(p.input)-start < streamMaxLookahead {
+				p.pos = start
+				break
+			}
+			if err != nil {
+				err = p.errorf(start, ParseErrorUnterminated, "Expected expansion to end within %d bytes", streamMaxLookahead)
+			}
+		}
+		if err != nil {
+			return 0, s.parseError(err)
+		}
+
+		for _, item := range items {
+			text := item.Text
+			if item.Expansion != nil {
+				if text, err = item.Expansion.Expand(s.env); err != nil {
+					if err = s.expansionError(err, item.Span); err != nil {
+						return 0, err
+					}
+				}
+			}
+			if _, err := io.WriteString(s.w, text); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	s.steps += p.steps
+	s.advance(buf[:p.pos])
+	return p.pos, nil
+}
+
+// advance moves the position in the stream past the bytes in done
+func (s *streamer) advance(done []byte) {
+	s.offset += len(done)
+	if i := bytes.LastIndexByte(done, '\n'); i >= 0 {
+		s.line += bytes.Count(done, []byte{'\n'})
+		s.column = utf8.RuneCount(done[i+1:])
+	} else {
+		s.column += utf8.RuneCount(done)
+	}
+}
+
+// parseError moves the position of a *ParseError from the buffer to the stream
+func (s *streamer) parseError(err error) error {
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		if parseErr.Line == 1 {
+			parseErr.Column += s.column
+		}
+		parseErr.Offset += s.offset
+		parseErr.Line += s.line
+	}
+	return err
+}
+
+// expansionError handles an expansion at span in the buffer that failed. With
+// Options.ContinueOnError it's kept to return at the end of the stream, otherwise it's returned as
+// a StreamError. Either way, the spans in it are moved to be from the start of the stream.
+func (s *streamer) expansionError(err error, span Span) error {
+	if s.opts.ContinueOnError {
+		n := len(s.errs)
+		s.errs = addExpansionError(s.errs, err, span)
+		for _, e := range s.errs[n:] {
+			e.Span = Span{Start: s.offset + e.Span.Start, End: s.offset + e.Span.End}
+			s.moveUnsetSpan(e.Err)
+		}
+		return nil
+	}
+
+	s.moveUnsetSpan(withSpan(err, span))
+	return &StreamError{Offset: s.offset + span.Start, Err: err}
+}
+
+// moveUnsetSpan moves the span of any UnsetVariableError from the buffer to the stream
+func (s *streamer) moveUnsetSpan(err error) {
+	var unsetErr *UnsetVariableError
+	if errors.As(err, &unsetErr) {
+		unsetErr.Span.Start += s.offset
+		unsetErr.Span.End += s.offset
+	}
+}
@@ -0,0 +1,38 @@
+package interpolate
+
+import (
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestStreamingUnclosedExpansionsTakeLinearSteps(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		str string
+		r   func(io.Reader) io.Reader
+	}{
+		{strings.Repeat("$((", 20), iotest.OneByteReader},
+		{strings.Repeat("$((", 400), iotest.OneByteReader},
+		{"$((" + strings.Repeat("x", 3*1024*1024), nil},
+		{"$${A:-" + strings.Repeat("x", 3*1024*1024), nil},
+	} {
+		var r io.Reader = strings.NewReader(tc.str)
+		if tc.r != nil {
+			r = tc.r(r)
+		}
+
+		s := &streamer{env: NewSliceEnv(nil), w: io.Discard}
+		if err := s.stream(r); err != nil {
+			t.Fatal(err)
+		}
+
+		// parsing what's pending from the start again after every read would take steps in
+		// proportion to the square of its length
+		if limit := 10 * len(tc.str); s.steps > limit {
+			t.Errorf("Streaming %q... took %d steps, want at most %d", tc.str[:min(len(tc.str), 12)], s.steps, limit)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+package interpolate_test
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/buildkite/interpolate"
+)
+
+// chunkReader reads a string a few bytes at a time, so that expansions span reads
+type chunkReader struct {
+	str  string
+	size int
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.str == "" {
+		return 0, io.EOF
+	}
+	n := copy(p[:min(len(p), r.size)], r.str)
+	r.str = r.str[n:]
+	return n, nil
+}
+
+func TestInterpolateStream(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{
+		"HELLO_WORLD": "🦀",
+		"NAME":        "Dolly",
+		"ÜBER":        "über",
+		"NUMBER":      "41",
+	})
+
+	for _, str := range []string{
+		``,
+		`Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}`,
+		`$NAME$NAME ${NAME}s ${NAME:-${HELLO_WORLD:-nope}} ${UNSET:-${NAME//l/L}}`,
+		`$$NAME \$NAME \\$NAME $$ ${#NAME} $ÜBER $`,
+		`$((NUMBER + 1)) $(echo $NAME) $((1 + (2 * $NUMBER))) $(( ) $((`,
+		"line one $NAME\nline two ${NAME:0:3}\n\n${NAME@Q}\\",
+		`${NAME:=x} ${NEW:=assigned} $NEW`,
+	} {
+		expected, err := interpolate.Interpolate(environ, str)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for size := 1; size <= 8; size++ {
+			var out strings.Builder
+			if err := interpolate.InterpolateStream(environ, &chunkReader{str: str, size: size}, &out); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != expected {
+				t.Fatalf("Test %q with %d byte reads failed: Expected %q, got %q", str, size, expected, out.String())
+			}
+		}
+	}
+}
+
+func TestInterpolateStreamWithOptions(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{"HOME": "/home/llama"})
+	opts := interpolate.Options{RespectQuotes: true}
+	str := `echo '$HOME ${' "$HOME's" $'it\'s $HOME' "${HOME}"`
+
+	expected, err := interpolate.InterpolateWithOptions(environ, str, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := interpolate.InterpolateStreamWithOptions(environ, iotest.OneByteReader(strings.NewReader(str)), &out, opts); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, out.String())
+	}
+}
+
+func TestInterpolateStreamLargeInput(t *testing.T) {
+	t.Parallel()
+
+	environ := interpolate.NewMapEnv(map[string]string{"STEP": "🦀 build"})
+	str := strings.Repeat("- command: echo ${STEP:-default} $$ESCAPED ${UNSET:-$STEP}\n", 20000)
+
+	expected, err := interpolate.Interpolate(environ, str)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := interpolate.InterpolateStream(environ, strings.NewReader(str), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != expected {
+		t.Fatalf("Expected %d bytes of output, got %d", len(expected), out.Len())
+	}
+}
+
+func TestInterpolateStreamErrors(t *testing.T) {
+	t.Parallel()
+
+	str := "steps:\n  - command: echo ${FOO~x}\n"
+
+	var out strings.Builder
+	err := interpolate.InterpolateStream(nil, iotest.OneByteReader(strings.NewReader(str)), &out)
+
+	var parseErr *interpolate.ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Expected a *ParseError, got %v", err)
+	}
+	if parseErr.Offset != 30 || parseErr.Line != 2 || parseErr.Column != 24 {
+		t.Fatalf("Expected an error at offset 30 (line 2, column 24), got %#v", parseErr)
+	}
+	if expected := "steps:\n  - command: echo "; out.String() != expected {
+		t.Fatalf("Expected %q to have been written, got %q", expected, out.String())
+	}
+
+	out.Reset()
+	str = "steps:\n  - command: echo ${FOO?is required}\n"
+	err = interpolate.InterpolateStream(nil, &chunkReader{str: str, size: 5}, &out)
+
+	var streamErr *interpolate.StreamError
+	if !errors.As(err, &streamErr) || streamErr.Offset != 25 {
+		t.Fatalf("Expected a *StreamError at offset 25, got %v", err)
+	}
+	if expected := "$FOO: is required (at offset 25)"; err.Error() != expected {
+		t.Fatalf("Expected error %q, got %q", expected, err.Error())
+	}
+	out.Reset()
+	str = "steps:\n  - command: echo ${BAR:-$FOO}\n"
+	err = interpolate.InterpolateStreamWithOptions(nil, &chunkReader{str: str, size: 5}, &out, interpolate.Options{NoUnset: true})
+
+	var unsetErr *interpolate.UnsetVariableError
+	if !errors.As(err, &unsetErr) || unsetErr.Span != (interpolate.Span{Start: 32, End: 36}) {
+		t.Fatalf("Expected an *UnsetVariableError at 32-36, got %#v", unsetErr)
+	}
+}
+
+func TestInterpolateStreamContinueOnError(t *testing.T) {
+	t.Parallel()
+
+	str := "steps:\n  - command: echo ${FOO?}\n  - command: echo ${BAR:-${BAZ?}}\n"
+
+	var out strings.Builder
+	err := interpolate.InterpolateStreamWithOptions(nil, &chunkReader{str: str, size: 5}, &out,
+		interpolate.Options{ContinueOnError: true})
+
+	var expansionErrs *interpolate.ExpansionErrors
+	if !errors.As(err, &expansionErrs) || len(expansionErrs.Errors) != 2 {
+		t.Fatalf("Expected an *ExpansionErrors with 2 errors, got %v", err)
+	}
+	if expected := "$FOO: not set (at offset 25)\n$BAZ: not set (at offset 58)"; err.Error() != expected {
+		t.Fatalf("Expected error %q, got %q", expected, err.Error())
+	}
+	if expected := "steps:\n  - command: echo \n  - command: echo \n"; out.String() != expected {
+		t.Fatalf("Expected output %q, got %q", expected, out.String())
+	}
+}
+
+func TestInterpolateStreamUnclosedArithmetic(t *testing.T) {
+	t.Parallel()
+
+	str := strings.Repeat("$((", 40)
+
+	var out strings.Builder
+	if err := interpolate.InterpolateStream(nil, iotest.OneByteReader(strings.NewReader(str)), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != str {
+		t.Fatalf("Expected %q, got %q", str, out.String())
+	}
+}
+
+// laggingWriter records how far writes lag behind what's been read from r
+type laggingWriter struct {
+	r       *countingReader
+	written int
+	lag     int // the most that had been read but not written when anything was written
+}
+
+func (w *laggingWriter) Write(p []byte) (int, error) {
+	w.lag = max(w.lag, w.r.n-w.written)
+	w.written += len(p)
+	return len(p), nil
+}
+
+// countingReader counts the bytes read from it
+type countingReader struct {
+	io.Reader
+	n int
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += n
+	return n, err
+}
+
+func TestInterpolateStreamUnclosedExpansions(t *testing.T) {
+	t.Parallel()
+
+	long := strings.Repeat("x", 3*1024*1024)
+	for _, str := range []string{"$((" + long, "$${A:-" + long, "$(" + long} {
+		expected, err := interpolate.Interpolate(nil, str)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r := &countingReader{Reader: strings.NewReader(str)}
+		w := &laggingWriter{r: r}
+		if err := interpolate.InterpolateStream(nil, r, w); err != nil {
+			t.Fatal(err)
+		}
+		if w.written != len(expected) {
+			t.Fatalf("Expected %d bytes of output, got %d", len(expected), w.written)
+		}
+
+		// an expansion that doesn't end is given up on rather than buffering the whole stream
+		if w.lag > 2*1024*1024+32*1024 {
+			t.Fatalf("Expected at most 2MB to be buffered, got %d bytes", w.lag)
+		}
+	}
+
+	// a brace expansion that doesn't end is an error, as it would be at the end of the input
+	err := interpolate.InterpolateStream(nil, strings.NewReader("${A:-"+long), io.Discard)
+	var parseErr *interpolate.ParseError
+	if !errors.As(err, &parseErr) || parseErr.Kind != interpolate.ParseErrorUnterminated || parseErr.Offset != 0 {
+		t.Fatalf("Expected an unterminated *ParseError at offset 0, got %v", err)
+	}
+}
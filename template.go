@@ -0,0 +1,68 @@
+package interpolate
+
+import (
+	"io"
+	"slices"
+	"strconv"
+)
+
+// Template is a compiled string that can be interpolated many times without parsing it again. A
+// Template is immutable, so it's safe to use from multiple goroutines at once.
+type Template struct {
+	source string
+	expr   Expression
+	opts   Options
+	refs   []Reference
+}
+
+// Compile parses str into a Template
+func Compile(str string) (*Template, error) {
+	return CompileWithOptions(str, Options{})
+}
+
+// CompileWithOptions is like Compile, but with options that change how the template is parsed and
+// expanded
+func CompileWithOptions(str string, opts Options) (*Template, error) {
+	expr, err := NewParserWithOptions(str, opts).Parse()
+	if err != nil {
+		return nil, err
+	}
+	return &Template{source: str, expr: expr, opts: opts, refs: expr.References()}, nil
+}
+
+// MustCompile is like Compile, but panics if str can't be parsed. It's intended for templates in
+// global variables, which are known to be valid.
+func MustCompile(str string) *Template {
+	t, err := Compile(str)
+	if err != nil {
+		panic("interpolate: Compile(" + strconv.Quote(str) + "): " + err.Error())
+	}
+	return t
+}
+
+// String returns the source the template was compiled from
+func (t *Template) String() string {
+	return t.source
+}
+
+// Expand interpolates env into the template, the same as Interpolate would with the template's source
+func (t *Template) Expand(env Env) (string, error) {
+	if env == nil {
+		env = NewSliceEnv(nil)
+	}
+	return t.expr.ExpandWithOptions(env, t.opts)
+}
+
+// ExpandTo is like Expand, but writes the result to w as it goes. If an expansion fails, whatever
+// came before it will already have been written.
+func (t *Template) ExpandTo(w io.Writer, env Env) error {
+	if env == nil {
+		env = NewSliceEnv(nil)
+	}
+	return t.expr.expandTo(w, withOptions(env, t.opts))
+}
+
+// References returns every reference to a variable within the template, as Expression.References does
+func (t *Template) References() []Reference {
+	return slices.Clone(t.refs)
+}
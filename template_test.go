@@ -0,0 +1,140 @@
+package interpolate_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/buildkite/interpolate"
+)
+
+func TestTemplate(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := interpolate.Compile(`Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// expand the same template with lots of environments at once
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			env := interpolate.NewMapEnv(map[string]string{"HELLO_WORLD": fmt.Sprintf("🦀 %d", i)})
+			result, err := tmpl.Expand(env)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if expected := fmt.Sprintf("Buildkite... 🦀 %d 🏖", i); result != expected {
+				t.Errorf("Expected %q, got %q", expected, result)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if result, err := tmpl.Expand(nil); err != nil || result != "Buildkite...  🏖" {
+		t.Fatalf("Expected expanding with a nil env to give %q, got %q (%v)", "Buildkite...  🏖", result, err)
+	}
+
+	if tmpl.String() != `Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}` {
+		t.Fatalf("Expected the template's source, got %q", tmpl.String())
+	}
+}
+
+func TestTemplateExpandTo(t *testing.T) {
+	t.Parallel()
+
+	tmpl := interpolate.MustCompile(`Hello ${NAME}, ${GREETING?no greeting} ${NAME}`)
+
+	var buf bytes.Buffer
+	env := interpolate.NewMapEnv(map[string]string{"NAME": "Dolly", "GREETING": "hello"})
+	if err := tmpl.ExpandTo(&buf, env); err != nil {
+		t.Fatal(err)
+	}
+	if expected := "Hello Dolly, hello Dolly"; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+
+	// output before the failed expansion has already been written
+	buf.Reset()
+	err := tmpl.ExpandTo(&buf, interpolate.NewMapEnv(map[string]string{"NAME": "Dolly"}))
+	if err == nil || err.Error() != "$GREETING: no greeting" {
+		t.Fatalf("Expected error %q, got %v", "$GREETING: no greeting", err)
+	}
+	if expected := "Hello Dolly, "; buf.String() != expected {
+		t.Fatalf("Expected %q, got %q", expected, buf.String())
+	}
+}
+
+func TestTemplateWithOptions(t *testing.T) {
+	t.Parallel()
+
+	tmpl, err := interpolate.CompileWithOptions(`echo '$HOME' "$HOME" $((1 + 2))`, interpolate.Options{RespectQuotes: true, NoArithmetic: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := tmpl.Expand(interpolate.NewMapEnv(map[string]string{"HOME": "/home/llama"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `echo '$HOME' "/home/llama" $((1 + 2))`; result != expected {
+		t.Fatalf("Expected %q, got %q", expected, result)
+	}
+}
+
+func TestTemplateReferences(t *testing.T) {
+	t.Parallel()
+
+	tmpl := interpolate.MustCompile(`${REGION:-$DEFAULT_REGION}`)
+
+	refs := tmpl.References()
+	if len(refs) != 2 || refs[0].Name != "REGION" || refs[1].Name != "DEFAULT_REGION" {
+		t.Fatalf("Expected references to REGION and DEFAULT_REGION, got %+v", refs)
+	}
+
+	// changing the result doesn't change the template
+	refs[0].Name = "CHANGED"
+	if refs := tmpl.References(); refs[0].Name != "REGION" {
+		t.Fatalf("Expected the template's references to be unchanged, got %+v", refs)
+	}
+}
+
+func TestCompileErrors(t *testing.T) {
+	t.Parallel()
+
+	_, err := interpolate.Compile(`${FOO`)
+
+	var parseErr *interpolate.ParseError
+	if !errors.As(err, &parseErr) {
+		t.Fatalf("Expected a *ParseError, got %v", err)
+	}
+
+	defer func() {
+		r := recover()
+		if msg, ok := r.(string); !ok || !strings.HasPrefix(msg, `interpolate: Compile("${FOO"): `) {
+			t.Fatalf("Expected MustCompile to panic, got %v", r)
+		}
+	}()
+	interpolate.MustCompile(`${FOO`)
+}
+
+func BenchmarkTemplateExpand(b *testing.B) {
+	env := interpolate.NewSliceEnv([]string{
+		"HELLO_WORLD=🦀",
+	})
+	tmpl := interpolate.MustCompile("Buildkite... ${HELLO_WORLD} ${ANOTHER_VAR:-🏖}")
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		_, _ = tmpl.Expand(env)
+	}
+}
@@ -0,0 +1,45 @@
+package interpolate
+
+// A Visitor's Visit method is called by Walk for each item in an expression. If it returns a non-nil
+// Visitor w, Walk then visits the items in any expressions within the item's expansion with w.
+type Visitor interface {
+	Visit(item ExpressionItem) (w Visitor)
+}
+
+// Walk traverses an expression in depth-first order, calling v.Visit for each item and then walking
+// the children of ParentExpansions with the Visitor it returns
+func Walk(expr Expression, v Visitor) {
+	for _, item := range expr {
+		w := v.Visit(item)
+		if w == nil {
+			continue
+		}
+		if pe, ok := item.Expansion.(ParentExpansion); ok {
+			for _, child := range pe.Children() {
+				Walk(child, w)
+			}
+		}
+	}
+}
+
+// Rewrite returns a copy of expr with every item replaced by the result of calling f on it. Items are
+// rewritten from the bottom up, so the children of a ParentExpansion have already been rewritten when
+// f is called for it. The original expression is left unchanged.
+func Rewrite(expr Expression, f func(item ExpressionItem) ExpressionItem) Expression {
+	if expr == nil {
+		return nil
+	}
+
+	rewritten := make(Expression, 0, len(expr))
+	for _, item := range expr {
+		if pe, ok := item.Expansion.(ParentExpansion); ok {
+			children := pe.Children()
+			for i, child := range children {
+				children[i] = Rewrite(child, f)
+			}
+			item.Expansion = pe.WithChildren(children)
+		}
+		rewritten = append(rewritten, f(item))
+	}
+	return rewritten
+}
@@ -0,0 +1,115 @@
+package interpolate_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/buildkite/interpolate"
+)
+
+// collector is a Visitor that records every expansion it visits, optionally without descending into them
+type collector struct {
+	visited []string
+	shallow bool
+}
+
+func (c *collector) Visit(item interpolate.ExpressionItem) interpolate.Visitor {
+	if item.Expansion != nil {
+		c.visited = append(c.visited, item.String())
+	}
+	if c.shallow {
+		return nil
+	}
+	return c
+}
+
+func TestWalk(t *testing.T) {
+	t.Parallel()
+
+	expr, err := interpolate.NewParser(`${A:-${B/$C/$D}} and $((E + $F)) ${G:?needs $H}`).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c collector
+	interpolate.Walk(expr, &c)
+
+	expected := []string{`${A:-${B/$C/$D}}`, `${B/$C/$D}`, `${C}`, `${D}`, `$((E + $F))`, `${F}`, `${G:?needs $H}`, `${H}`}
+	if !reflect.DeepEqual(c.visited, expected) {
+		t.Fatalf("Expected to visit %v, visited %v", expected, c.visited)
+	}
+
+	shallow := collector{shallow: true}
+	interpolate.Walk(expr, &shallow)
+
+	expected = []string{`${A:-${B/$C/$D}}`, `$((E + $F))`, `${G:?needs $H}`}
+	if !reflect.DeepEqual(shallow.visited, expected) {
+		t.Fatalf("Expected to visit %v, visited %v", expected, shallow.visited)
+	}
+}
+
+func TestRewrite(t *testing.T) {
+	t.Parallel()
+
+	const str = `${OLD:-$OLD} ${OTHER/$OLD} $((OLD + 1)) ${OLD_NAME}`
+	expr, err := interpolate.NewParser(str).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rename := func(item interpolate.ExpressionItem) interpolate.ExpressionItem {
+		switch e := item.Expansion.(type) {
+		case interpolate.VariableExpansion:
+			if e.Identifier == "OLD" {
+				e.Identifier = "NEW"
+			}
+			item.Expansion = e
+		case interpolate.EmptyValueExpansion:
+			if e.Identifier == "OLD" {
+				e.Identifier = "NEW"
+			}
+			item.Expansion = e
+		}
+		return item
+	}
+
+	rewritten := interpolate.Rewrite(expr, rename)
+
+	if expected := `${NEW:-$NEW} ${OTHER/$NEW} $((OLD + 1)) $OLD_NAME`; rewritten.String() != expected {
+		t.Fatalf("Expected rewritten expression %q, got %q", expected, rewritten.String())
+	}
+	if expected := `${OLD:-$OLD} ${OTHER/$OLD} $((OLD + 1)) $OLD_NAME`; expr.String() != expected {
+		t.Fatalf("Expected original expression to be unchanged, got %q", expr.String())
+	}
+}
+
+func TestParentExpansions(t *testing.T) {
+	t.Parallel()
+
+	for _, str := range []string{
+		`${A:-x}`, `${A-x}`, `${A:=x}`, `${A=x}`, `${A:+x}`, `${A+x}`, `${A:?x}`, `${A?x}`,
+		`${A#x}`, `${A##x}`, `${A%x}`, `${A%%x}`, `${A/x}`, `${A//x/x}`, `${A/#x/x}`, `${A/%x/x}`,
+		`${A^x}`, `${A^^x}`, `${A,x}`, `${A,,x}`, `$((x))`,
+	} {
+		expr, err := interpolate.NewParser(str).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := expr[0].Expansion.(interpolate.ParentExpansion); !ok {
+			t.Fatalf("Expected %q to be a ParentExpansion, got %T", str, expr[0].Expansion)
+		}
+
+		rewritten := interpolate.Rewrite(expr, func(item interpolate.ExpressionItem) interpolate.ExpressionItem {
+			if item.Text == "x" {
+				item.Text = "y"
+			}
+			return item
+		})
+
+		if expected := strings.ReplaceAll(str, "x", "y"); rewritten.String() != expected {
+			t.Fatalf("Expected %q to be rewritten to %q, got %q", str, expected, rewritten.String())
+		}
+	}
+}